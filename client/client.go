@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
@@ -13,18 +14,25 @@ import (
 
 const (
 	ReadWriteDeadLine = 15*time.Second
-	CommonFileReadSize = 200*1024*1024 //can compress more than 80%
-	DataFileReadSize = 20*1024*1024  // compress only little
+	CommonFileReadSize = 2*1024*1024 //can compress more than 80%
+	DataFileReadSize = 1*1024*1024  // compress only little
+	DefaultWindowSize = 8
+	DefaultMaxStreams = 64
+	DigestHashRate = 32*1024*1024 // bytes per second the server reads at least to check a digest
 )
 
 var (
 	clientCfg ClientCfgInfo
+	clientTLS *tls.Config // nil without tls
+	clientTransport syncf.Transport // of upload addr
+	clientCred *syncf.Credential // nil without auth
 )
 
 
 func main() {
 	initEnv()
 
+	http.HandleFunc("/debug/compress", handleCompressStats)
 	go func() {
 		log.Println(http.ListenAndServe(clientCfg.DebugAddr, nil))
 	}()
@@ -48,6 +56,31 @@ func initEnv() {
 	if clientCfg.GoRPoolSize != 0 {
 		lGPoolSize = clientCfg.GoRPoolSize
 	}
+	if clientCfg.WindowSize <= 0 {
+		clientCfg.WindowSize = DefaultWindowSize
+	}
+	if clientCfg.MaxStreams <= 0 {
+		clientCfg.MaxStreams = DefaultMaxStreams
+	}
+	if clientCfg.CompressThreshold <= 0 {
+		clientCfg.CompressThreshold = DefaultCompressThreshold
+	}
+	var err error
+	if clientTransport, err = syncf.NewTransport(clientCfg.Transport, clientCfg.KCP); err != nil {
+		log.Fatal("invalid Transport ", clientCfg.Transport)
+	}
+	if clientCfg.TLS {
+		clientTLS, err = syncf.ClientTLS(clientCfg.TLSCert, clientCfg.TLSKey, clientCfg.TLSCA, clientCfg.TLSServerName)
+		if err != nil {
+			log.Fatal("syncf.ClientTLS failed ", err)
+		}
+		if clientCfg.Transport == syncf.TransportUnix && len(clientCfg.TLSServerName) == 0 {
+			log.Fatal("TLSServerName required for tls over unix socket")
+		}
+	}
+	if len(clientCfg.ClientID) > 0 {
+		clientCred = &syncf.Credential{ID: clientCfg.ClientID, Token: clientCfg.AuthToken, Secret: clientCfg.AuthSecret}
+	}
 
 	for l, r := range clientCfg.LRPathMap {
 		path, err := filepath.Abs(l)
@@ -58,5 +91,35 @@ func initEnv() {
 		clientCfg.LRPathMapWithPre[path] = svrPath
 		clientCfg.RPathWithPre = append(clientCfg.RPathWithPre, svrPath)
 	}
+
+	defaultPathOption.Symlink = SymlinkFollow
+	clientCfg.LPathOptionAbs = make(map[string]*PathOption)
+	for l, opt := range clientCfg.LPathOption {
+		path, err := filepath.Abs(l)
+		if err != nil || opt == nil {
+			continue
+		}
+		if len(opt.Symlink) == 0 {
+			opt.Symlink = SymlinkFollow
+		}
+		if opt.Symlink != SymlinkFollow && opt.Symlink != SymlinkPreserve && opt.Symlink != SymlinkSkip {
+			log.Fatal("invalid Symlink option ", l, " ", opt.Symlink)
+		}
+		if opt.Codec != syncf.CodecNone {
+			codec := syncf.GetCodec(opt.Codec)
+			if len(opt.Codec) == 0 {
+				codec = syncf.GetCodec(syncf.CodecGzip)
+			}
+			if codec == nil {
+				log.Fatal("invalid Codec option ", l, " ", opt.Codec)
+			}
+			if _, err := codec.Compress(nil, []byte(l), opt.CodecLevel); err != nil {
+				log.Fatal("invalid CodecLevel option ", l, " ", opt.CodecLevel, " ", err)
+			}
+		}
+		clientCfg.LPathOptionAbs[path] = opt
+	}
+	initRateLimits()
+	initUploadQueue()
 }
 
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syncfile/syncf"
+)
+
+// a chunk is compressed only when a sample of it compresses below the
+// threshold. the sampled ratio of each file extension is learned, an extension
+// found incompressible is only sampled again every probeInterval chunks
+
+const (
+	DefaultCompressThreshold = 0.9
+	sampleSize               = 8 * 1024 // of each of the 3 samples
+	learnSamples             = 4        // samples before an extension is judged
+	probeInterval            = 16
+	estimateWeight           = 0.25 // of a new sample in the estimate
+)
+
+type ExtStat struct {
+	Chunks     int64   `json:"chunks"`
+	Compressed int64   `json:"compressed"`
+	RawBytes   int64   `json:"rawbytes"`
+	SentBytes  int64   `json:"sentbytes"`
+	Ratio      float64 `json:"ratio"`    // sentbytes / rawbytes
+	Samples    int64   `json:"samples"`  // chunks sampled
+	Estimate   float64 `json:"estimate"` // moving average of sampled ratio
+}
+
+type CompressStats struct {
+	sync.Mutex
+	exts map[string]*ExtStat
+}
+
+var (
+	compressStats = newCompressStats(DataFileSuffix)
+)
+
+// extensions of seed are known incompressible until sampled otherwise
+func newCompressStats(seed []string) *CompressStats {
+	stats := &CompressStats{exts: make(map[string]*ExtStat)}
+	for _, ext := range seed {
+		stats.exts[ext] = &ExtStat{Samples: learnSamples, Estimate: 1}
+	}
+	return stats
+}
+
+func fileExt(fname string) string {
+	return strings.ToLower(filepath.Ext(fname))
+}
+
+func (stats *CompressStats) get(ext string) *ExtStat {
+	st, ok := stats.exts[ext]
+	if !ok {
+		st = &ExtStat{}
+		stats.exts[ext] = st
+	}
+	return st
+}
+
+func (st *ExtStat) incompressible(threshold float64) bool {
+	return st.Samples >= learnSamples && st.Estimate >= threshold
+}
+
+// files of an incompressible extension are read in smaller chunks
+func (stats *CompressStats) Incompressible(fname string) bool {
+	stats.Lock()
+	defer stats.Unlock()
+	st, ok := stats.exts[fileExt(fname)]
+	return ok && st.incompressible(clientCfg.CompressThreshold)
+}
+
+// whether chunk of fname is worth compressing by codec
+func (stats *CompressStats) ShouldCompress(fname string, chunk []byte, codec syncf.Codec, level int) bool {
+	ext := fileExt(fname)
+	threshold := clientCfg.CompressThreshold
+	stats.Lock()
+	st := stats.get(ext)
+	if st.incompressible(threshold) && st.Chunks%probeInterval != 0 {
+		stats.Unlock()
+		return false
+	}
+	stats.Unlock()
+
+	ratio := sampleRatio(chunk, codec, level)
+
+	stats.Lock()
+	defer stats.Unlock()
+	if st.Samples == 0 {
+		st.Estimate = ratio
+	} else {
+		st.Estimate += (ratio - st.Estimate) * estimateWeight
+	}
+	st.Samples++
+	return ratio < threshold
+}
+
+// size of a chunk sent, compressed or not
+func (stats *CompressStats) Record(fname string, raw int, sent int, compressed bool) {
+	stats.Lock()
+	defer stats.Unlock()
+	st := stats.get(fileExt(fname))
+	st.Chunks++
+	if compressed {
+		st.Compressed++
+	}
+	st.RawBytes += int64(raw)
+	st.SentBytes += int64(sent)
+	st.Ratio = float64(st.SentBytes) / float64(st.RawBytes)
+}
+
+func (stats *CompressStats) Snapshot() map[string]ExtStat {
+	stats.Lock()
+	defer stats.Unlock()
+	rst := make(map[string]ExtStat, len(stats.exts))
+	for k, v := range stats.exts {
+		rst[k] = *v
+	}
+	return rst
+}
+
+// compressed ratio of samples at head, middle and tail of chunk
+func sampleRatio(chunk []byte, codec syncf.Codec, level int) float64 {
+	var sample []byte
+	if len(chunk) <= 3*sampleSize {
+		sample = chunk
+	} else {
+		mid := len(chunk)/2 - sampleSize/2
+		sample = make([]byte, 0, 3*sampleSize)
+		sample = append(sample, chunk[:sampleSize]...)
+		sample = append(sample, chunk[mid:mid+sampleSize]...)
+		sample = append(sample, chunk[len(chunk)-sampleSize:]...)
+	}
+
+	data, err := codec.Compress(nil, sample, level)
+	if err != nil || len(sample) == 0 {
+		return 1
+	}
+	return float64(len(data)) / float64(len(sample))
+}
+
+// per extension statistics on DebugAddr, key "" is files without extension
+func handleCompressStats(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(compressStats.Snapshot())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
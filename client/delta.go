@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"syncfile/syncf"
+	"time"
+)
+
+// a rewritten file is sent as delta against the copy on server,
+// any failure falls back to upload the whole file
+
+func putDeltaPool(fname string) (err error) {
+	err = lGPool.Submit(func() {
+		handDelta(fname)
+	})
+	if err != nil {
+		log.Println("lGPool.Submit failed")
+	}
+	return err
+}
+
+func handDelta(fname string) {
+	file, err := os.Open(fname)
+	if err != nil {
+		log.Println("OpenFile failed ", fname, err)
+		lFileMap.SetFileUploading(fname, false)
+		return
+	}
+
+	err = sendDelta(file, fname)
+	_ = file.Close()
+	if err != nil {
+		log.Println("Delta upload failed, upload whole file ", fname, err)
+		handUpload(fname, 0)
+		return
+	}
+	lFileMap.SetFileUploading(fname, false)
+}
+
+func sendDelta(file *os.File, fname string) error {
+	iSize, err := syncf.GetFileSize(file)
+	if err != nil {
+		return err
+	}
+	strPath := clientCfg.GetSvrFullPath(fname)
+	if len(strPath) == 0 || len(strPath) > syncf.MaxFramePath {
+		return errors.New("server path get failed")
+	}
+
+	stream, err := muxPool.OpenStream(clientCfg.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	if !stream.Caps.HasFeature(syncf.FeatureDelta) {
+		stream.Close(false)
+		return errors.New("server not support " + syncf.FeatureDelta)
+	}
+
+	inflight := 0
+	defer func() {
+		stream.Close(inflight > 0)
+	}()
+
+	// signatures of the server copy
+	req := syncf.Frame{Op: syncf.OpSigReq, Path: strPath, Pos: syncf.DeltaBlockSize(iSize)}
+	if err = stream.Send(&req); err != nil {
+		inflight = 1
+		return err
+	}
+	// server reads the whole old file for them
+	fileUpInfo, _ := lFileMap.GetFile(fname)
+	rsp, err := stream.RecvWait(digestWait(fileUpInfo.size))
+	if err != nil {
+		inflight = 1
+		return err
+	}
+	if rsp.Op != syncf.OpSigs || rsp.Result != syncf.Succeed {
+		return errors.New("signature request failed")
+	}
+	sig, err := syncf.DecodeSignature(rsp.Payload)
+	if err != nil {
+		return err
+	}
+
+	fileDigest := syncf.NewFileDigest()
+	if err = fileDigest.Update(file, iSize); err != nil {
+		return err
+	}
+	digest, blocks := fileDigest.Sum()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	maxBatch := CommonFileReadSize
+	if maxBatch > stream.Caps.MaxChunk {
+		maxBatch = stream.Caps.MaxChunk
+	}
+	var seq uint32
+	var mode uint32
+	var mtime int64
+	pos := 0
+	literal, err := syncf.GenDelta(sig, io.NewSectionReader(file, 0, int64(iSize)), maxBatch, func(ops []byte, n int) error {
+		seq++
+		frame := syncf.Frame{Op: syncf.OpDelta, Flags: syncf.FlagSeq | syncf.FlagChecksum, Seq: seq, Path: strPath,
+			Pos: pos, TolSize: iSize, Payload: ops, Checksum: syncf.Checksum(ops)}
+		if pos+n == iSize {
+			frame.Flags |= syncf.FlagDigest
+			frame.Digest = digest
+			if stream.Caps.HasFeature(syncf.FeatureMeta) {
+				setFrameMeta(&frame, fi, clientCfg.GetPathOption(fname).SyncOwner)
+				mode, mtime = frame.Mode, frame.MTime
+			}
+		}
+		throttle(stream.RemoteAddr(), fname, len(frame.Payload))
+		if err := stream.Send(&frame); err != nil {
+			return err
+		}
+		inflight++
+		pos += n
+
+		for inflight >= stream.Window || (pos == iSize && inflight > 0) {
+			var extra time.Duration
+			if pos == iSize {
+				extra = digestWait(iSize)
+			}
+			if err := recvDeltaAck(stream, extra); err != nil {
+				return err
+			}
+			inflight--
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if pos != iSize {
+		return errors.New("file changed when making delta")
+	}
+
+	log.Println("Delta upload succeed, size", iSize, " literal", literal, fname)
+	lFileMap.UpdateFileP(fname, iSize, iSize, true)
+	lFileMap.SetFileBlocks(fname, blocks)
+	if mtime != 0 {
+		lFileMap.SetFileMeta(fname, mode, mtime)
+	} else {
+		lFileMap.SetFileMeta(fname, uint32(fi.Mode()), fi.ModTime().UnixNano())
+	}
+	return nil
+}
+
+func recvDeltaAck(stream *syncf.Stream, extra time.Duration) error {
+	rsp, err := stream.RecvWait(extra)
+	if err != nil {
+		return err
+	}
+	if rsp.Op != syncf.OpResult || rsp.Result != syncf.Succeed {
+		return errors.New("delta rejected by server")
+	}
+	return nil
+}
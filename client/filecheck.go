@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"path"
 	"strings"
 	"sync"
 	"syncfile/syncf"
@@ -18,6 +19,8 @@ const (
 	NeedUpload int = iota
 	Uploading
 	NoneedUpload
+	NeedDelta
+	NeedPatch
 )
 
 const (
@@ -26,7 +29,7 @@ const (
 )
 
 var (
-	DataFileSuffix = []string{".zip", ".gz", ".pdf", ".jpg", ".png",  ".dmg",}
+	DataFileSuffix = []string{".zip", ".gz", ".pdf", ".jpg", ".png",  ".dmg",} // known incompressible
 )
 
 type ClientCfgInfo struct {
@@ -34,10 +37,43 @@ type ClientCfgInfo struct {
 	RemoteApiAddr string  `json:"RemoteApiAddr"`
 	DebugAddr     string  `json:"DebugAddr"`
 	GoRPoolSize   int     `json:"GoRoutinePoolSize"`
+	WindowSize    int     `json:"WindowSize"` // chunks in flight per upload
+	MaxStreams    int     `json:"MaxStreams"` // uploads on one connection
+	CompressThreshold float64 `json:"CompressThreshold"` // compress chunk if sampled ratio below
+	Transport     string  `json:"Transport"` // of upload addr, tcp(default), unix or kcp
+	KCP           *syncf.KCPConfig `json:"KCP"` // fec shards same as server
+	RateLimit     int     `json:"RateLimit"` // bytes/s of all uploads, 0 no limit
+	ServerRateLimit map[string]int `json:"ServerRateLimit"` // bytes/s of uploads to a server addr
+	TLS           bool    `json:"TLS"`     // tls to upload and api addr
+	TLSCert       string  `json:"TLSCert"` // client cert for server requires one
+	TLSKey        string  `json:"TLSKey"`
+	TLSCA         string  `json:"TLSCA"`         // ca of server cert, system ca if not set
+	TLSServerName string  `json:"TLSServerName"` // name in server cert, host of addr if not set, required of unix
+	ClientID      string  `json:"ClientID"`   // auth to server if set
+	AuthToken     string  `json:"AuthToken"`  // pre-shared token, use with tls
+	AuthSecret    string  `json:"AuthSecret"` // key of hmac challenge-response, used if set
+	Schedule      []string `json:"Schedule"` // upload order rules, default priority, smallest, oldest
+	MaxWait       int     `json:"MaxWait"` // s, a file queued longer is uploaded first, default 300
+	PriorityGlobs map[string]int `json:"PriorityGlobs"` // priority of files matching glob
 	RemotePathPre string `json:"RemotePathPre"`
 	LRPathMap   map[string]string  `json:"LocalRemotePathPair"`
+	LPathOption map[string]*PathOption `json:"LocalPathOption"` // same key as LocalRemotePathPair
 	LRPathMapWithPre  map[string]string  // no prefix in conf file, need add to mem cfg
 	RPathWithPre []string  // all server paths with prefix
+	LPathOptionAbs map[string]*PathOption // key is abs local path
+}
+
+type PathOption struct {
+	SyncDelete bool `json:"SyncDelete"` // delete server file when local file removed
+	SyncOwner  bool `json:"SyncOwner"`  // send uid and gid, mode and mtime always sent
+	Symlink    string `json:"Symlink"`  // follow, preserve or skip
+	Delta      bool `json:"Delta"`      // send changed blocks only when a synced file is rewritten
+	Codec      string `json:"Codec"`    // gzip(default), zstd, lz4, snappy or none
+	CodecLevel int  `json:"CodecLevel"` // 0 is the default level of codec
+	RateLimit  int  `json:"RateLimit"`  // bytes/s of uploads of the path, 0 no limit
+	Priority   int  `json:"Priority"`   // of files in the path, higher first
+	QuietMs    int  `json:"QuietMs"`    // upload after size and mtime unchanged so long, 0 at once
+	MaxDelayMs int  `json:"MaxDelayMs"` // upload a file still changing after so long, default 60000
 }
 
 type FileEvent struct {
@@ -50,6 +86,12 @@ type FileUpInfo struct {
 	size     int
 	pos      int
 	uploading bool
+	ino      uint64
+	mode     uint32 // mode and mtime on server
+	mtime    int64
+	link     string // local target of symlink sent to server
+	blocks   []uint32 // crc32c of blocks on server, nil if unknown
+	dirty    bool // changed while uploading, queued again when the upload ends
 }
 
 type LocalFileMap struct {
@@ -57,70 +99,55 @@ type LocalFileMap struct {
 	Map map[string]*FileUpInfo
 }
 
-type FileChangeMap struct {
+// monitored local directories
+type LocalDirMap struct {
 	sync.Mutex
-	cond *sync.Cond
-	Map map[string]struct{}
+	Map map[string]uint32 // mode on server
 }
 
 var (
 	fileWatcher *fsnotify.Watcher
 	//fileEventChan chan fsnotify.Event
 	lFileMap LocalFileMap
-	fileChangeMap  FileChangeMap
+	lDirMap  = LocalDirMap{Map: make(map[string]uint32)}
+	defaultPathOption PathOption
 )
 
 
-func (cfg *ClientCfgInfo) GetSvrFullPath(fname string) string{
-	index := strings.LastIndex(fname, "/")
-	if index < 1 {
-		return ""
-	}
-	path := fname[:index]
+// the monitored local path fname is under, the nearest one if nested
+func (cfg *ClientCfgInfo) GetLocalPath(fname string) string {
+	for {
+		index := strings.LastIndex(fname, "/")
+		if index < 1 {
+			return ""
+		}
+		fname = fname[:index]
 
-	for k, v := range cfg.LRPathMapWithPre {
-		if k == path {
-			return v + fname[index:]
+		if _, isExist := cfg.LRPathMapWithPre[fname]; isExist {
+			return fname
 		}
 	}
-
-	return ""
 }
 
-func (fileChangeMap *FileChangeMap) AddFile(fname string) {
-	fileChangeMap.Lock()
-	defer fileChangeMap.Unlock()
-
-	if _, isExist := fileChangeMap.Map[fname]; !isExist {
-		fileChangeMap.Map[fname] = struct{}{}
-		fileChangeMap.cond.Signal()
+func (cfg *ClientCfgInfo) GetSvrFullPath(fname string) string{
+	path := cfg.GetLocalPath(fname)
+	if len(path) == 0 {
+		return ""
 	}
-}
 
-func (fileChangeMap *FileChangeMap) DelFile(fname string) {
-	fileChangeMap.Lock()
-	defer fileChangeMap.Unlock()
-
-	if _, isExist := fileChangeMap.Map[fname]; isExist {
-		delete(fileChangeMap.Map, fname)
-	}
+	return cfg.LRPathMapWithPre[path] + fname[len(path):]
 }
 
-func (fileChangeMap *FileChangeMap) GetAnyFileAndDel() string {
-	fileChangeMap.Lock()
-	defer fileChangeMap.Unlock()
-
-	if len(fileChangeMap.Map) == 0{
-		fileChangeMap.cond.Wait()
-	}
-
-	for fname := range fileChangeMap.Map {
-		delete(fileChangeMap.Map, fname)
-		return fname
+// option of a monitored local path
+func (cfg *ClientCfgInfo) GetLocalPathOption(path string) *PathOption {
+	if opt, isExist := cfg.LPathOptionAbs[path]; isExist {
+		return opt
 	}
+	return &defaultPathOption
+}
 
-	return ""
-
+func (cfg *ClientCfgInfo) GetPathOption(fname string) *PathOption {
+	return cfg.GetLocalPathOption(cfg.GetLocalPath(fname))
 }
 
 func (localFileMap *LocalFileMap) UpdateFile(fileUpInfo *FileUpInfo) {
@@ -138,49 +165,103 @@ func (localFileMap *LocalFileMap) UpdateFile(fileUpInfo *FileUpInfo) {
 
 func (localFileMap *LocalFileMap) UpdateFileP(fname string, pos int, size int, uploading bool) {
 	localFileMap.Lock()
-	defer localFileMap.Unlock()
-
+	dirty := false
 	if _, isExist := localFileMap.Map[fname]; isExist {
 		localFileMap.Map[fname].size = size
 		localFileMap.Map[fname].pos = pos
-		localFileMap.Map[fname].uploading = uploading
+		dirty = localFileMap.Map[fname].setUploading(uploading)
+	}
+	localFileMap.Unlock()
+
+	if dirty {
+		uploadQueue.AddFile(fname)
 	}
 }
 
+// a file changed while uploading is queued again when the upload ends
 func (localFileMap *LocalFileMap) SetFileUploading(fname string, uploading bool) {
+	localFileMap.Lock()
+	dirty := false
+	if _, isExist := localFileMap.Map[fname]; isExist {
+		dirty = localFileMap.Map[fname].setUploading(uploading)
+	}
+	localFileMap.Unlock()
+
+	if dirty {
+		uploadQueue.AddFile(fname)
+	}
+}
+
+// true if the upload ends with the file dirty
+func (fileUpInfo *FileUpInfo) setUploading(uploading bool) bool {
+	fileUpInfo.uploading = uploading
+	if uploading || !fileUpInfo.dirty {
+		return false
+	}
+	fileUpInfo.dirty = false
+	return true
+}
+
+// mark the file dirty if uploading, false if not
+func (localFileMap *LocalFileMap) MarkDirty(fname string) bool {
 	localFileMap.Lock()
 	defer localFileMap.Unlock()
 
-	if _, isExist := localFileMap.Map[fname]; isExist {
-		localFileMap.Map[fname].uploading = uploading
+	if fileUpInfo, isExist := localFileMap.Map[fname]; isExist && fileUpInfo.uploading {
+		fileUpInfo.dirty = true
+		return true
 	}
+	return false
 }
 
-func (localFileMap *LocalFileMap) GetAndSetUploadStat(fname string, isize int) (pos int, stat int) {
+// NeedDelta only if delta is true and the server has the whole old file,
+// NeedPatch if size not changed but mtime changed
+func (localFileMap *LocalFileMap) GetAndSetUploadStat(fname string, isize int, ino uint64, mtime int64, delta bool) (pos int, stat int) {
 	localFileMap.Lock()
 	defer localFileMap.Unlock()
 
 	if _, isExist := localFileMap.Map[fname]; !isExist {
-		fileUpInfo := &FileUpInfo{fname, isize, 0, true}
+		fileUpInfo := &FileUpInfo{fname: fname, size: isize, uploading: true, ino: ino}
 		localFileMap.Map[fname] = fileUpInfo
 		return NeedUpload, 0
 	}
+	localFileMap.Map[fname].ino = ino
 
 	if localFileMap.Map[fname].uploading {
+		localFileMap.Map[fname].dirty = true
 		return Uploading, 0
 	}
 
+	if len(localFileMap.Map[fname].link) > 0 {
+		log.Println("GetAndSetUploadStat symlink replaced by file", fname)
+		localFileMap.Map[fname] = &FileUpInfo{fname: fname, size: isize, uploading: true, ino: ino}
+		return NeedUpload, 0
+	}
+
+	if delta && localFileMap.Map[fname].pos > 0 && localFileMap.Map[fname].pos == localFileMap.Map[fname].size &&
+		localFileMap.Map[fname].size != isize {
+		localFileMap.Map[fname].uploading = true
+		localFileMap.Map[fname].blocks = nil
+		return NeedDelta, 0
+	}
+
 	if localFileMap.Map[fname].size == isize {
 		if localFileMap.Map[fname].pos == localFileMap.Map[fname].size {
+			if localFileMap.Map[fname].mtime != 0 && localFileMap.Map[fname].mtime != mtime {
+				localFileMap.Map[fname].uploading = true
+						return NeedPatch, 0
+			}
 			return NoneedUpload, 0
 		} else if localFileMap.Map[fname].pos < localFileMap.Map[fname].size {
 			localFileMap.Map[fname].uploading = true
+			localFileMap.Map[fname].blocks = nil
 			return NeedUpload, localFileMap.Map[fname].pos
 		} else {
 			log.Println("GetAndSetUploadStat pos > size", fname, localFileMap.Map[fname].pos,isize)
 			localFileMap.Map[fname].pos = 0
 			localFileMap.Map[fname].uploading = true
-			return NeedUpload, 0
+			localFileMap.Map[fname].blocks = nil
+				return NeedUpload, 0
 		}
 	}
 
@@ -189,14 +270,92 @@ func (localFileMap *LocalFileMap) GetAndSetUploadStat(fname string, isize int) (
 		log.Println("GetAndSetUploadStat size > newsize, upload again", fname, localFileMap.Map[fname].size, isize)
 		localFileMap.Map[fname].pos = 0
 		localFileMap.Map[fname].uploading = true
+		localFileMap.Map[fname].blocks = nil
 		return NeedUpload, 0
 	} else {
 		localFileMap.Map[fname].uploading = true
+		localFileMap.Map[fname].blocks = nil
 		return NeedUpload, localFileMap.Map[fname].pos
 	}
 
 }
 
+// copy of file info
+func (localFileMap *LocalFileMap) GetFile(fname string) (FileUpInfo, bool) {
+	localFileMap.Lock()
+	defer localFileMap.Unlock()
+
+	if fileUpInfo, isExist := localFileMap.Map[fname]; isExist {
+		return *fileUpInfo, true
+	}
+	return FileUpInfo{}, false
+}
+
+// move info of old name to new name, mark uploading until server renamed
+func (localFileMap *LocalFileMap) MoveFile(oldName string, newName string) bool {
+	localFileMap.Lock()
+	defer localFileMap.Unlock()
+
+	fileUpInfo, isExist := localFileMap.Map[oldName]
+	if !isExist || fileUpInfo.uploading {
+		return false
+	}
+	if newInfo, isExist := localFileMap.Map[newName]; isExist && newInfo.uploading {
+		return false
+	}
+
+	delete(localFileMap.Map, oldName)
+	fileUpInfo.fname = newName
+	fileUpInfo.uploading = true
+	localFileMap.Map[newName] = fileUpInfo
+	return true
+}
+
+// record target of symlink, false if the same target already recorded
+func (localFileMap *LocalFileMap) SetLink(fname string, target string) bool {
+	localFileMap.Lock()
+	defer localFileMap.Unlock()
+
+	if fileUpInfo, isExist := localFileMap.Map[fname]; isExist && fileUpInfo.link == target {
+		return false
+	}
+	localFileMap.Map[fname] = &FileUpInfo{fname: fname, link: target}
+	return true
+}
+
+// block hash of the file content on server
+func (localFileMap *LocalFileMap) SetFileBlocks(fname string, blocks []uint32) {
+	localFileMap.Lock()
+	defer localFileMap.Unlock()
+
+	if fileUpInfo, isExist := localFileMap.Map[fname]; isExist {
+		fileUpInfo.blocks = blocks
+	}
+}
+
+// mode and mtime on server, false if file not exist
+func (localFileMap *LocalFileMap) SetFileMeta(fname string, mode uint32, mtime int64) bool {
+	localFileMap.Lock()
+	defer localFileMap.Unlock()
+
+	if fileUpInfo, isExist := localFileMap.Map[fname]; isExist {
+		fileUpInfo.mode = mode
+		fileUpInfo.mtime = mtime
+		return true
+	}
+	return false
+}
+
+func (localFileMap *LocalFileMap) MetaChanged(fname string, mode uint32, mtime int64) bool {
+	localFileMap.Lock()
+	defer localFileMap.Unlock()
+
+	if fileUpInfo, isExist := localFileMap.Map[fname]; isExist {
+		return fileUpInfo.mode != mode || fileUpInfo.mtime != mtime
+	}
+	return false
+}
+
 func (localFileMap *LocalFileMap) DelFile(fname string) {
 	localFileMap.Lock()
 	defer localFileMap.Unlock()
@@ -206,6 +365,30 @@ func (localFileMap *LocalFileMap) DelFile(fname string) {
 	}
 }
 
+// true if dir is new or mode changed
+func (localDirMap *LocalDirMap) AddDir(path string, mode uint32) bool {
+	localDirMap.Lock()
+	defer localDirMap.Unlock()
+
+	if m, isExist := localDirMap.Map[path]; isExist && m == mode {
+		return false
+	}
+	localDirMap.Map[path] = mode
+	return true
+}
+
+// false if not exist
+func (localDirMap *LocalDirMap) DelDir(path string) bool {
+	localDirMap.Lock()
+	defer localDirMap.Unlock()
+
+	if _, isExist := localDirMap.Map[path]; isExist {
+		delete(localDirMap.Map, path)
+		return true
+	}
+	return false
+}
+
 func startMonitrFile() {
 	var err error
 	fileWatcher, err = fsnotify.NewWatcher()
@@ -214,8 +397,7 @@ func startMonitrFile() {
 	}
 
 	lFileMap.Map =  make(map[string]*FileUpInfo)
-	fileChangeMap.Map = make(map[string]struct{})
-	fileChangeMap.cond = sync.NewCond(&fileChangeMap.Mutex)
+	go fileSettler.Run(settleInterval)
 
 	//fileEventChan = make(chan fsnotify.Event, FileEventChanSize)
 	go func() {
@@ -225,27 +407,32 @@ func startMonitrFile() {
 				if !ok {
 					return
 				}
-				if  event.Op&fsnotify.Chmod == fsnotify.Chmod {
-					continue
-				}
-
-				if syncf.IsDir(event.Name) {
+				// move of a watched dir itself, its parent has the event
+				if len(event.Name) == 0 {
 					continue
 				}
-
 				//no need check tmp file
 				iPos := strings.LastIndex(event.Name, "/")
 				if iPos > 0 && iPos < len(event.Name) && event.Name[iPos+1] == '.'{
 					continue
 				}
 
-				iSpace := strings.Index(event.Name, " ")
-				if iSpace >=0 {
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					watchEvent(event.Name, false)
+				}
+				if event.Op&fsnotify.Rename == fsnotify.Rename {
+					renameMap.AddOld(event.Name)
 					continue
 				}
+				if event.Op&fsnotify.Create == fsnotify.Create && renameMap.PairNew(event.Name) {
+					continue
+				}
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					watchEvent(event.Name, true)
+				}
 
 				//fileEventChan <- event
-				fileChangeMap.AddFile(event.Name)
+				settleFile(event.Name)
 
 			case err, ok := <-fileWatcher.Errors:
 				if !ok {
@@ -257,7 +444,7 @@ func startMonitrFile() {
 	}()
 
 	for k, _ := range clientCfg.LRPathMapWithPre {
-		err = fileWatcher.Add(k)
+		err = watchTree(k, false)
 		if err != nil {
 			log.Fatal("fileWatcher.Add failed:", err)
 		}
@@ -272,67 +459,159 @@ func checkDifWithSvr() {
 	var lfiles, sfiles []syncf.FileStat
 	var fileUpInfo *FileUpInfo
 	for kl, vl := range clientCfg.LRPathMapWithPre {
-		lfiles = syncf.GetPathFileStat(kl)
-		if len(lfiles) == 0 {
+		if !syncf.IsDir(kl) {
 			continue
 		}
+		lfiles = treeFileStat(kl)
+		sfiles = nil
 		for _, vs := range rspPathFile.Pathfiles {
 			if vs.Path == vl {
 				sfiles = vs.Files
 				break
 			}
 		}
+		smap := make(map[string]syncf.FileStat, len(sfiles))
+		for _, vsf := range sfiles {
+			smap[vsf.FileName] = vsf
+		}
 
 		for _, vlf := range lfiles {
+			if len(vlf.Link) > 0 {
+				switch clientCfg.GetLocalPathOption(kl).Symlink {
+				case SymlinkSkip:
+					continue
+				case SymlinkPreserve:
+					checkLinkWithSvr(kl + "/" + vlf.FileName, vlf, sfiles)
+					continue
+				}
+				// follow, check as the target
+				fileStat, err := syncf.GetFileStat(kl + "/" + vlf.FileName)
+				if err != nil && err != syncf.ErrIsDir || err == syncf.ErrIsDir && !isFollowedLink(kl + "/" + vlf.FileName) {
+					continue
+				}
+				fileStat.FileName = vlf.FileName
+				vlf = fileStat
+			}
+			if vlf.IsDir {
+				checkDirWithSvr(kl + "/" + vlf.FileName, vlf, sfiles)
+				continue
+			}
+
 			bDif := true
 			pos := 0
-			for _, vsf := range sfiles {
-				if vsf == vlf && vsf.Size == vlf.Size {
+			var svrMode uint32
+			var svrMTime int64
+			size := vlf.Size
+			if vsf, ok := smap[vlf.FileName]; ok {
+				if vsf.Size == vlf.Size && !vsf.IsDir {
 					bDif = false
 					pos = vsf.Size
+					svrMode, svrMTime = vsf.Mode, vsf.ModTime
+				} else if vsf.Size > 0 && !vsf.IsDir && len(vsf.Link) == 0 &&
+					clientCfg.GetLocalPathOption(kl).Delta {
+					// changed when client offline, delta against the server copy
+					pos, size = vsf.Size, vsf.Size
 				}
 			}
 
-			fileUpInfo = &FileUpInfo{kl + "/" + vlf.FileName, vlf.Size, pos, false}
+			fileUpInfo = &FileUpInfo{fname: kl + "/" + vlf.FileName, size: size, pos: pos, ino: vlf.Ino}
 			lFileMap.UpdateFile(fileUpInfo)
 
 			if bDif {
-				fileChangeMap.AddFile(fileUpInfo.fname)
+				uploadQueue.AddFile(fileUpInfo.fname)
+			} else if lFileMap.SetFileMeta(fileUpInfo.fname, svrMode, svrMTime) &&
+				lFileMap.MetaChanged(fileUpInfo.fname, vlf.Mode, vlf.ModTime) {
+				uploadQueue.AddFile(fileUpInfo.fname)
+			}
+		}
+
+		// removed when client offline, the change loop finds it not exist and deletes it
+		if !clientCfg.GetLocalPathOption(kl).SyncDelete {
+			continue
+		}
+		lmap := make(map[string]struct{}, len(lfiles))
+		for _, vlf := range lfiles {
+			lmap[vlf.FileName] = struct{}{}
+		}
+		for _, vsf := range sfiles {
+			if _, bExist := lmap[vsf.FileName]; !bExist {
+				// removed with its dir
+				if dir := path.Dir(vsf.FileName); dir != "." {
+					if _, ok := lmap[dir]; !ok {
+						continue
+					}
+				}
+				if vsf.IsDir {
+					lDirMap.AddDir(kl + "/" + vsf.FileName, vsf.Mode)
+				}
+				uploadQueue.AddFile(kl + "/" + vsf.FileName)
 			}
 		}
 	}
 
 }
 
+// directory not on server is created by change loop
+func checkDirWithSvr(path string, dir syncf.FileStat, sfiles []syncf.FileStat) {
+	for _, vsf := range sfiles {
+		if vsf.FileName == dir.FileName && vsf.IsDir {
+			lDirMap.AddDir(path, vsf.Mode)
+			if vsf.Mode != dir.Mode {
+				uploadQueue.AddFile(path)
+			}
+			return
+		}
+	}
+	uploadQueue.AddFile(path)
+}
+
 func getFileDesFromSvr(rspPathFile *syncf.PathFileRsq) {
 	var err error
 	var resp *http.Response
 	var reqData syncf.PathFileReq
 	var data []byte
-	var body bytes.Buffer
 	reqData.RPaths = clientCfg.RPathWithPre
+	reqData.Recursive = true
 	data, err = json.Marshal(reqData)
 	if err != nil {
 		log.Fatal("getDiffFromSvr, json.Marshal failed", err)
 		return
 	}
-	body.Write(data)
 
 	client := &http.Client{}
 	client.Timeout = time.Second * 15
 	url := "http://" + clientCfg.RemoteApiAddr + "/api/getpathfile"
-	req, _ := http.NewRequest("Get", url, &body)
+	if clientTLS != nil {
+		client.Transport = &http.Transport{TLSClientConfig: clientTLS}
+		url = "https://" + clientCfg.RemoteApiAddr + "/api/getpathfile"
+	}
 
+	// request signed again on each try, the time of the sign would be out of
+	// AuthMaxSkew when server is down long. 401 may be of a stale sign too
 	for {
+		req, _ := http.NewRequest("Get", url, bytes.NewReader(data))
+		if clientCred != nil {
+			for k, v := range clientCred.SignHeader(data) {
+				req.Header.Set(k, v)
+			}
+		}
 		resp, err = client.Do(req)
-		if err == nil {
+		if err == nil && resp.StatusCode != http.StatusUnauthorized {
 			break
 		}
-		log.Println("getDiffFromSvr:" + url + " error:" + err.Error())
+		if err == nil {
+			log.Println("getDiffFromSvr:" + url + " status:" + resp.Status)
+			resp.Body.Close()
+		} else {
+			log.Println("getDiffFromSvr:" + url + " error:" + err.Error())
+		}
 		time.Sleep(time.Second*10)
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatal("getDiffFromSvr:" + url + " status:" + resp.Status)
+	}
 	data, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Fatal("getDiffFromSvr:" + url + "ioutil.ReadAll error:" + err.Error())
@@ -346,10 +625,8 @@ func getFileDesFromSvr(rspPathFile *syncf.PathFileRsq) {
 }
 
 func CheckFileType(fname string) int {
-	for i := 0; i < len(DataFileSuffix); i++ {
-		if strings.LastIndex(fname, DataFileSuffix[i]) > 0 {
-			return FileData
-		}
+	if compressStats.Incompressible(fname) {
+		return FileData
 	}
 
 	return FileCommon
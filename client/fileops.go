@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"syncfile/syncf"
+	"time"
+)
+
+// operations without file data, one frame and one result
+
+func putDeletePool(fname string) (err error) {
+	err = lGPool.Submit(func() {
+		handDelete(fname)
+	})
+	if err != nil {
+		log.Println("lGPool.Submit failed")
+	}
+	return err
+}
+
+func handDelete(fname string) {
+	strPath := clientCfg.GetSvrFullPath(fname)
+	if len(strPath) == 0 {
+		log.Println("handDelete server path get failed", fname)
+		return
+	}
+
+	frame := syncf.Frame{Op: syncf.OpDelete, Path: strPath}
+	iRst, err := sendOperation(&frame, syncf.FeatureDelete)
+	if err != nil || iRst != syncf.Succeed {
+		log.Println("handDelete failed ", fname, iRst, err)
+		return
+	}
+	log.Println("Delete succeed", fname)
+}
+
+func putRenamePool(oldName string, newName string) (err error) {
+	err = lGPool.Submit(func() {
+		handRename(oldName, newName)
+	})
+	if err != nil {
+		log.Println("lGPool.Submit failed")
+	}
+	return err
+}
+
+// on failure upload new name as a new file and check old name as removed
+func handRename(oldName string, newName string) {
+	strOld := clientCfg.GetSvrFullPath(oldName)
+	strNew := clientCfg.GetSvrFullPath(newName)
+
+	frame := syncf.Frame{Op: syncf.OpRename, Path: strOld, Payload: []byte(strNew)}
+	iRst, err := sendOperation(&frame, syncf.FeatureRename)
+	if err != nil || iRst != syncf.Succeed {
+		log.Println("handRename failed, upload again ", oldName, newName, iRst, err)
+		lFileMap.UpdateFileP(newName, 0, 0, false)
+		uploadQueue.AddFile(oldName)
+		uploadQueue.AddFile(newName)
+		return
+	}
+
+	log.Println("Rename succeed", oldName, newName)
+	lFileMap.SetFileUploading(newName, false)
+	uploadQueue.AddFile(newName) // may change after rename
+}
+
+// create or remove directory on server
+func putDirPool(path string, op uint8) (err error) {
+	err = lGPool.Submit(func() {
+		handDir(path, op)
+	})
+	if err != nil {
+		log.Println("lGPool.Submit failed")
+	}
+	return err
+}
+
+func handDir(path string, op uint8) {
+	strPath := clientCfg.GetSvrFullPath(path)
+	if len(strPath) == 0 {
+		log.Println("handDir server path get failed", path)
+		return
+	}
+
+	frame := syncf.Frame{Op: op, Path: strPath}
+	if fi, err := os.Stat(path); err == nil && op == syncf.OpMkdir {
+		setFrameMeta(&frame, fi, clientCfg.GetPathOption(path).SyncOwner)
+		frame.MTime = 0 // changes with the files in it
+	}
+	iRst, err := sendOperation(&frame, syncf.FeatureDir)
+	if err != nil || iRst != syncf.Succeed {
+		log.Println("handDir failed ", path, op, iRst, err)
+		if op == syncf.OpMkdir {
+			lDirMap.DelDir(path) // try again on next event
+		}
+		return
+	}
+	log.Println("Dir operation succeed", path, op)
+}
+
+func putMetaPool(fname string) (err error) {
+	err = lGPool.Submit(func() {
+		handMeta(fname)
+	})
+	if err != nil {
+		log.Println("lGPool.Submit failed")
+	}
+	return err
+}
+
+// set mode, mtime and owner of a file already on server
+func handMeta(fname string) {
+	strPath := clientCfg.GetSvrFullPath(fname)
+	if len(strPath) == 0 {
+		log.Println("handMeta server path get failed", fname)
+		return
+	}
+
+	fi, err := os.Stat(fname)
+	if err != nil {
+		log.Println("os.Stat failed ", fname, err)
+		return
+	}
+
+	frame := syncf.Frame{Op: syncf.OpSetMeta, Path: strPath}
+	setFrameMeta(&frame, fi, clientCfg.GetPathOption(fname).SyncOwner)
+
+	iRst, err := sendOperation(&frame, syncf.FeatureMeta)
+	if err != nil || iRst != syncf.Succeed {
+		log.Println("handMeta failed ", fname, iRst, err)
+		if iRst == syncf.FileNotExist {
+			lFileMap.UpdateFileP(fname, 0, 0, false)
+			uploadQueue.AddFile(fname)
+			return
+		}
+	}
+	// not sent again until changed, also when server not support
+	lFileMap.SetFileMeta(fname, frame.Mode, frame.MTime)
+	if err == nil && iRst == syncf.Succeed {
+		log.Println("Meta set succeed", fname)
+	}
+}
+
+// send frame of op and wait result, server must support feature
+func sendOperation(frame *syncf.Frame, feature string) (int, error) {
+	if len(frame.Path) > syncf.MaxFramePath ||
+		frame.Op == syncf.OpRename && len(frame.Payload) > syncf.MaxFramePath {
+		return 0, errors.New("server path too long")
+	}
+
+	stream, err := muxPool.OpenStream(clientCfg.RemoteAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	if !stream.Caps.HasFeature(feature) {
+		stream.Close(false)
+		return 0, errors.New("server not support " + feature)
+	}
+
+	// a file written by another request is busy for one chunk, send again
+	var rsp *syncf.Frame
+	for i := 0; ; i++ {
+		if err = stream.Send(frame); err != nil {
+			stream.Close(true)
+			return 0, err
+		}
+
+		rsp, err = stream.Recv()
+		if err != nil {
+			stream.Close(true)
+			return 0, err
+		}
+		if rsp.Op != syncf.OpResult || rsp.Result != syncf.FileUsing || i >= MaxChunkRetry {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if rsp.Op != syncf.OpResult {
+		stream.Close(true)
+		return 0, errors.New("rsp op error")
+	}
+
+	stream.Close(false)
+	return rsp.Result, nil
+}
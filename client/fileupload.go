@@ -2,8 +2,8 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"github.com/panjf2000/ants/v2"
+	"io"
 	"log"
 	"os"
 	"sync"
@@ -11,18 +11,30 @@ import (
 	"time"
 )
 
+const (
+	MaxChunkRetry = 3
+)
+
 var (
 	connPool *syncf.ConnPool
+	muxPool *syncf.MuxPool
 	lGPoolSize = 50
 )
 
 var (
 	lGPool *ants.Pool
+	// one chunk read and its compressed data for each upload, memory is
+	// bounded by the goroutine pool size
 	cBufPool = sync.Pool{
 		New: func() interface{} {
 			return make([]byte, CommonFileReadSize)
 		},
 	}
+	zBufPool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, 0, CommonFileReadSize)
+		},
+	}
 )
 
 
@@ -39,39 +51,88 @@ func FileChgHandleLoop() {
 	}
 	defer lGPool.Release()
 
+	hello := syncf.NewHello(CommonFileReadSize)
+	hello.MaxStreams = clientCfg.MaxStreams
+	hello.StreamWindow = clientCfg.WindowSize
+	if clientCred != nil {
+		hello.Features = append(append([]string(nil), hello.Features...), syncf.FeatureAuth)
+	}
 	connPool = &syncf.ConnPool{DiaTimout:ReadWriteDeadLine,
-		RWTimeout:ReadWriteDeadLine, MaxIdleConns:20}
-	go connPool.CheckIdleConn(300)
+		RWTimeout:ReadWriteDeadLine, MaxIdleConns:20, Hello:&hello, TLS:clientTLS, Cred:clientCred,
+		Transport:clientTransport}
+	muxPool = &syncf.MuxPool{Pool: connPool}
+	go muxPool.CheckIdleConn(300)
 
 	for {
-		fname = fileChangeMap.GetAnyFileAndDel()
+		fname = uploadQueue.Next()
 		if len(fname) == 0 {
 			time.Sleep(time.Second * 10) //abnormal
 			continue
 		}
 
+		target, isLink := syncf.ReadLink(fname)
+		if isLink && clientCfg.GetPathOption(fname).Symlink != SymlinkFollow {
+			if clientCfg.GetPathOption(fname).Symlink == SymlinkPreserve && lFileMap.SetLink(fname, target) {
+				_ = putLinkPool(fname, target)
+			}
+			continue
+		}
+
 		// check pos and uploading
 		fileStat, err = syncf.GetFileStat(fname)
+		if err == syncf.ErrIsDir {
+			if isLink && !isFollowedLink(fname) {
+				continue // target in synced tree
+			}
+			if lDirMap.AddDir(fname, fileStat.Mode) {
+				_ = putDirPool(fname, syncf.OpMkdir)
+			}
+			continue
+		}
 		if err != nil {
 			log.Println("syncf.GetFileStat failed", err)
+			if os.IsNotExist(err) && lDirMap.DelDir(fname) {
+				if clientCfg.GetPathOption(fname).SyncDelete {
+					_ = putDirPool(fname, syncf.OpRmdir)
+				}
+				continue
+			}
 			if os.IsNotExist(err) {
+				if lFileMap.MarkDirty(fname) {
+					continue // deleted after the upload ends
+				}
 				lFileMap.DelFile(fname)
+				if clientCfg.GetPathOption(fname).SyncDelete {
+					_ = putDeletePool(fname)
+				}
 			}
 			continue
 		}
 
-		upStat,upPos = lFileMap.GetAndSetUploadStat(fname, fileStat.Size)
+		upStat,upPos = lFileMap.GetAndSetUploadStat(fname, fileStat.Size, fileStat.Ino, fileStat.ModTime,
+			clientCfg.GetPathOption(fname).Delta)
 		if upStat == NoneedUpload {
+			// only mode or mtime changed
+			if lFileMap.MetaChanged(fname, fileStat.Mode, fileStat.ModTime) {
+				_ = putMetaPool(fname)
+			}
 			continue
 		}
 		if upStat == Uploading {
-			fileChangeMap.AddFile(fname)
-			continue
+			continue // marked dirty, queued again when the upload ends
 		}
 
 		// upload file
-		err = putHandlePool(fname, upPos)
+		if upStat == NeedDelta {
+			err = putDeltaPool(fname)
+		} else if upStat == NeedPatch {
+			err = putPatchPool(fname)
+		} else {
+			err = putHandlePool(fname, upPos)
+		}
 		if err != nil {
+			lFileMap.SetFileUploading(fname, false) // not started, try again
+			uploadQueue.AddFile(fname)
 			time.Sleep(time.Second*2)
 		}
 	}
@@ -109,32 +170,31 @@ func handUpload(fname string, pos int) {
 		_ = file.Close()
 		if pos != iSize && iSize != 0 {
 			time.Sleep(time.Second*5)  // try again later
-			fileChangeMap.AddFile(fname)
+			uploadQueue.AddFile(fname)
 		}
 	}()
 
-	var connection *syncf.Connection
-	connection, err = connPool.Get(clientCfg.RemoteAddr)
+	var stream *syncf.Stream
+	stream, err = muxPool.OpenStream(clientCfg.RemoteAddr)
 	if err != nil {
-		log.Println("connPool.Get failed ", err)
+		log.Println("muxPool.OpenStream failed ", err)
 		lFileMap.SetFileUploading(fname,false)
 		return
 	}
 
-	connPutFlag := true
+	// acks not read yet are left on stream
+	var inflight []chunkInfo
+	streamOk := true
 	defer func() {
-		if connPutFlag {
-			var errConn error
-			connPool.Put(clientCfg.RemoteAddr, connection, &errConn)
-		}
+		stream.Close(!streamOk || len(inflight) > 0)
 		lFileMap.SetFileUploading(fname,false)
 	}()
 
-
-
 	buf := cBufPool.Get().([]byte)
+	zbuf := zBufPool.Get().([]byte)
 	defer func() {
-		cBufPool.Put(buf)
+		cBufPool.Put(buf[:cap(buf)])
+		zBufPool.Put(zbuf)
 	}()
 
 	iReadSize := CommonFileReadSize
@@ -142,98 +202,271 @@ func handUpload(fname string, pos int) {
 	if iFileType != FileCommon {
 		iReadSize= DataFileReadSize
 	}
+	if iReadSize > stream.Caps.MaxChunk {
+		iReadSize = stream.Caps.MaxChunk
+	}
+	codec, iLevel := pathCodec(stream, fname)
+	bChecksum := stream.Caps.HasFeature(syncf.FeatureChecksum)
+	bDigest := stream.Caps.HasFeature(syncf.FeatureDigest)
+	bMeta := stream.Caps.HasFeature(syncf.FeatureMeta)
+	bOwner := clientCfg.GetPathOption(fname).SyncOwner
+	iWindow := stream.Window
+
+	var rsp *syncf.Frame
+	var seq uint32
+	var blocks []uint32 // block hash of the last chunk sent
+	// digest of the whole local file as sent, chunks from 0 are hashed when
+	// read, the part not read in this upload is read again at the end
+	digest := syncf.NewFileDigest()
+	sendPos := pos
+	iRetry, iDigestRetry := 0, 0
 
 	for pos < iSize {
-		_, err = file.Seek(int64(pos), 0)
-		if err != nil {
-			log.Println("file.Seek failed ", fname, err)
-			return
-		}
+		// keep the window full
+		for len(inflight) < iWindow && sendPos < iSize {
+			iRead := iReadSize
+			if iRead > iSize-sendPos {
+				iRead = iSize - sendPos // file may grow, keep chunk inside iSize
+			}
 
-		var nr int
-		nr, err = file.Read(buf[0:iReadSize])
-		if err != nil {
-			log.Println("file.Read failed ", fname, err)
-			return
+			var nr int
+			nr, err = file.ReadAt(buf[0:iRead], int64(sendPos))
+			if err != nil && !(err == io.EOF && nr > 0) {
+				log.Println("file.Read failed ", fname, err)
+				return
+			}
+
+			buf = buf[:nr]
+			if bDigest && sendPos == digest.Size() {
+				_, _ = digest.Write(buf)
+			}
+			seq++
+			frame := syncf.Frame{Op: syncf.OpWrite, Flags: syncf.FlagSeq, Seq: seq, Pos: sendPos, TolSize: iSize}
+			if bChecksum {
+				frame.Flags |= syncf.FlagChecksum
+			}
+			if bDigest && sendPos+nr == iSize {
+				if err = digest.Update(file, iSize); err != nil {
+					log.Println("FileDigest.Update failed ", fname, err)
+					return
+				}
+				frame.Digest, blocks = digest.Sum()
+				frame.Flags |= syncf.FlagDigest
+			}
+			var fi os.FileInfo
+			if sendPos+nr == iSize {
+				if fi, err = file.Stat(); err != nil {
+					log.Println("file.Stat failed ", fname, err)
+					return
+				}
+				if bMeta {
+					setFrameMeta(&frame, fi, bOwner)
+				}
+			}
+
+			err = PackData(&frame, buf, fname, codec, iLevel, zbuf)
+			if err != nil {
+				log.Println("PackData failed ", fname, err)
+				return
+			}
+
+			throttle(stream.RemoteAddr(), fname, len(frame.Payload))
+			err = stream.Send(&frame)
+			if err != nil {
+				log.Println("stream.Send failed ", err, stream.RemoteAddr(),
+					fname, len(frame.Payload))
+				return
+			}
+
+			log.Println("Send data succeed, pos", sendPos, " size", nr, fname)
+			chunk := chunkInfo{seq: seq, pos: sendPos, size: nr, last: frame.Flags&syncf.FlagDigest != 0}
+			if fi != nil { // recorded if server not applies meta, same size changes are found by it
+				chunk.mode, chunk.mtime = uint32(fi.Mode()), fi.ModTime().UnixNano()
+			}
+			inflight = append(inflight, chunk)
+			sendPos += nr
 		}
 
-		buf = buf[:nr]
-		var data []byte
-		data, err = PackData(buf, fname, pos, iFileType)
+		rsp, err = stream.RecvWait(ackWait(inflight))
 		if err != nil {
-			log.Println("PackData failed ", fname, err)
+			log.Println("stream.Recv failed ", err, stream.RemoteAddr())
 			return
 		}
 
-		connection.ExtendDeadline()
-		_, err = connection.Conn.Write(data)
-		if err != nil {
-			log.Println("Conn.Write failed ", err, connection.Conn.RemoteAddr(),
-				fname, len(data))
-			connPutFlag = false
+		iChunk := findChunk(inflight, rsp)
+		if rsp.Op != syncf.OpResult || iChunk < 0 {
+			log.Println("Rsp op err ", rsp.Op, rsp.Seq, fname)
+			streamOk = false
 			return
 		}
 
-		log.Println("Send data succeed, pos", pos, " size", len(buf), fname)
+		iRst, iRspPos := rsp.Result, rsp.Pos
+		if iRst == syncf.Succeed {
+			inflight[iChunk].acked = true
+			if inflight[iChunk].mtime != 0 {
+				lFileMap.SetFileMeta(fname, inflight[iChunk].mode, inflight[iChunk].mtime)
+			}
+			if inflight[iChunk].last {
+				lFileMap.SetFileBlocks(fname, blocks)
+			}
+			for len(inflight) > 0 && inflight[0].acked {
+				pos = inflight[0].pos + inflight[0].size
+				inflight = inflight[1:]
+			}
+			iRetry = 0
+
+			iSize, err = syncf.GetFileSize(file)
+			if err != nil {
+				return
+			}
 
-		var n int
-		connection.ExtendDeadline()
-		n, err = connection.Conn.Read(buf[0:iReadSize])
-		if err != nil {
-			log.Println("Conn.Read failed ", err, connection.Conn.RemoteAddr())
-			connPutFlag = false
-			return
+			lFileMap.UpdateFileP(fname, pos, iSize, true)
+			continue
 		}
 
-		buf = buf[0:n]
-		var icount, iRst, iRspPos int
-		icount, err = fmt.Sscanf(string(buf), "%d %d\n", &iRst, &iRspPos)
-		if icount != 2 || err != nil {
-			log.Println("fmt.Sscanf failed ", err, fname)
+		// the chunks after a failed one are rejected by server, wait their acks and send again
+		failed := inflight[iChunk]
+		inflight = append(inflight[:iChunk], inflight[iChunk+1:]...)
+		if !drainAcks(stream, &inflight) {
 			return
 		}
 
-		if iRst != syncf.Succeed && iRst != syncf.FilePosErr {
+		if iRst == syncf.ChecksumErr && iRetry < MaxChunkRetry {
+			iRetry++
+			log.Println("Rsp checksum err, send again, pos", failed.pos, fname)
+			pos = failed.pos
+		} else if iRst == syncf.DigestErr && iDigestRetry < MaxChunkRetry {
+			iDigestRetry++
+			log.Println("Rsp digest err, upload whole file again", fname)
+			pos = 0
+			digest.Reset()
+		} else if iRst == syncf.FilePosErr {
+			pos = iRspPos
+		} else {
 			log.Println("Rsp err ", iRst, iRspPos)
 			return
 		}
 
-		if iRst == syncf.FilePosErr {
-			pos = iRspPos
-		} else {
-			pos += nr
+		sendPos = pos
+		lFileMap.UpdateFileP(fname, pos, iSize, true)
+	}
+}
+
+type chunkInfo struct {
+	seq   uint32
+	pos   int
+	size  int
+	acked bool
+	mode  uint32 // meta sent with chunk
+	mtime int64
+	last  bool // with digest of whole file
+}
+
+// index of the chunk acked by rsp, server without seq acks in order
+func findChunk(inflight []chunkInfo, rsp *syncf.Frame) int {
+	if rsp.Flags&syncf.FlagSeq == 0 {
+		for i := range inflight {
+			if !inflight[i].acked {
+				return i
+			}
 		}
+		return -1
+	}
 
-		iSize, err = syncf.GetFileSize(file)
-		if err != nil {
-			return
+	for i := range inflight {
+		if inflight[i].seq == rsp.Seq && !inflight[i].acked {
+			return i
 		}
+	}
+	return -1
+}
 
-		lFileMap.UpdateFileP(fname, pos, iSize, true)
+// server hashes the whole file before the ack of a chunk with digest
+func ackWait(inflight []chunkInfo) time.Duration {
+	for _, c := range inflight {
+		if c.last && !c.acked {
+			return digestWait(c.pos + c.size)
+		}
 	}
+	return 0
+}
 
+func digestWait(size int) time.Duration {
+	return time.Duration(size/DigestHashRate) * time.Second
+}
 
+// read the acks of chunks still in flight and drop them
+func drainAcks(stream *syncf.Stream, inflight *[]chunkInfo) bool {
+	for _, c := range *inflight {
+		if c.acked {
+			continue
+		}
+		if _, err := stream.RecvWait(ackWait(*inflight)); err != nil {
+			log.Println("drainAcks stream.Recv failed ", err, stream.RemoteAddr())
+			return false
+		}
+	}
+	*inflight = (*inflight)[:0]
+	return true
 }
 
-func PackData(buf []byte, fname string, pos int, ftype int) ([]byte, error) {
-	var data []byte
-	var bCmpress bool
-	if ftype == FileCommon && len(buf) > 200 {
-		data = syncf.GzipCompress(buf)
-		if len(data) == 0 {
-			return nil, errors.New("syncf.GzipCompress failed")
+// mode, mtime and owner of file, applied by server when file complete
+func setFrameMeta(frame *syncf.Frame, fi os.FileInfo, owner bool) {
+	frame.Flags |= syncf.FlagMeta
+	frame.Mode = uint32(fi.Mode())
+	frame.MTime = fi.ModTime().UnixNano()
+	if uid, gid, ok := syncf.FileOwner(fi); owner && ok {
+		frame.Flags |= syncf.FlagOwner
+		frame.Uid, frame.Gid = uid, gid
+	}
+}
+
+// codec and level of fname negotiated with server, nil if not compress
+func pathCodec(stream *syncf.Stream, fname string) (syncf.Codec, int) {
+	opt := clientCfg.GetPathOption(fname)
+	if opt.Codec == syncf.CodecNone {
+		return nil, 0
+	}
+	name, level := opt.Codec, opt.CodecLevel
+	if len(name) == 0 {
+		name = syncf.CodecGzip
+	}
+	if !stream.Caps.HasCodec(name) {
+		name, level = syncf.CodecGzip, 0 // server not support the codec
+		if !stream.Caps.HasCodec(name) {
+			return nil, 0
 		}
-		bCmpress = true
-	} else {
-		data = buf
 	}
+	return syncf.GetCodec(name), level
+}
 
+// fill path and payload of frame, checksum set if FlagChecksum in flags.
+// payload is compressed by codec into zbuf if not nil and the sample of buf compressible
+func PackData(frame *syncf.Frame, buf []byte, fname string, codec syncf.Codec, level int, zbuf []byte) error {
 	strPath := clientCfg.GetSvrFullPath(fname)
 	if len(strPath) == 0 {
-		return nil, errors.New("server path get failed")
+		return errors.New("server path get failed")
+	}
+
+	if len(strPath) > syncf.MaxFramePath {
+		return errors.New("server path too long")
 	}
 
-	strHead := fmt.Sprintf("%s %d %d %d %t\n", strPath, pos, len(data), len(data), bCmpress)
+	frame.Path = strPath
+	frame.Payload = buf
+	if codec != nil && len(buf) > 200 && compressStats.ShouldCompress(fname, buf, codec, level) {
+		if err := syncf.CompressFrame(frame, codec, level, buf, zbuf); err != nil {
+			return errors.New(codec.Name() + " compress failed: " + err.Error())
+		}
+		if len(frame.Payload) >= len(buf) {
+			frame.Payload = buf // sample misled
+			frame.Flags &^= syncf.FlagCompress | syncf.FlagCodec
+		}
+	}
+	compressStats.Record(fname, len(buf), len(frame.Payload), frame.Flags&syncf.FlagCompress != 0)
+	if frame.Flags&syncf.FlagChecksum != 0 {
+		frame.Checksum = syncf.Checksum(buf)
+	}
 
-	return append([]byte(strHead), data...), nil
+	return nil
 }
\ No newline at end of file
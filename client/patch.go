@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"syncfile/syncf"
+	"time"
+)
+
+// a file with same size and new mtime is compared with the block hash of the
+// server content, only changed blocks are written at their pos on server.
+// without the block hash, after a restart or of a server not keeping mtime,
+// it is checked by delta against the server copy
+
+var (
+	errNoChange = errors.New("no block changed")
+	errNoBlocks = errors.New("no block hash of server file")
+)
+
+func putPatchPool(fname string) (err error) {
+	err = lGPool.Submit(func() {
+		handPatch(fname)
+	})
+	if err != nil {
+		log.Println("lGPool.Submit failed")
+	}
+	return err
+}
+
+func handPatch(fname string) {
+	file, err := os.Open(fname)
+	if err != nil {
+		log.Println("OpenFile failed ", fname, err)
+		lFileMap.SetFileUploading(fname, false)
+		return
+	}
+
+	err = sendPatch(file, fname)
+	_ = file.Close()
+	if err == errNoChange {
+		lFileMap.SetFileUploading(fname, false)
+		handMeta(fname) // only mtime changed
+		return
+	}
+	if err == errNoBlocks {
+		// signatures only cross the network if not changed
+		log.Println("Patch no block hash, delta against server ", fname)
+		handDelta(fname)
+		return
+	}
+	if err != nil {
+		log.Println("Patch upload failed, upload again ", fname, err)
+		if clientCfg.GetPathOption(fname).Delta {
+			handDelta(fname)
+		} else {
+			handUpload(fname, 0)
+		}
+		return
+	}
+	lFileMap.SetFileUploading(fname, false)
+}
+
+// pos and size of changed blocks, adjacent blocks are merged up to maxSize
+func changedBlocks(old []uint32, cur []uint32, size int, maxSize int) (ranges [][2]int) {
+	for i := range cur {
+		if cur[i] == old[i] {
+			continue
+		}
+		pos := i * syncf.HashBlockSize
+		l := syncf.HashBlockSize
+		if pos+l > size {
+			l = size - pos
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][0]+ranges[n-1][1] == pos && ranges[n-1][1]+l <= maxSize {
+			ranges[n-1][1] += l
+			continue
+		}
+		ranges = append(ranges, [2]int{pos, l})
+	}
+	return ranges
+}
+
+func sendPatch(file *os.File, fname string) error {
+	fileUpInfo, isExist := lFileMap.GetFile(fname)
+	iSize, err := syncf.GetFileSize(file)
+	if err != nil {
+		return err
+	}
+	if !isExist || fileUpInfo.size != iSize || fileUpInfo.blocks == nil || len(fileUpInfo.blocks) != syncf.HashBlockCount(iSize) {
+		return errNoBlocks
+	}
+
+	fileDigest := syncf.NewFileDigest()
+	if err = fileDigest.Update(file, iSize); err != nil {
+		return err
+	}
+	digest, blocks := fileDigest.Sum()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	stream, err := muxPool.OpenStream(clientCfg.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	if !stream.Caps.HasFeature(syncf.FeaturePatch) {
+		stream.Close(false)
+		return errors.New("server not support " + syncf.FeaturePatch)
+	}
+
+	inflight := 0
+	defer func() {
+		stream.Close(inflight > 0)
+	}()
+
+	iReadSize := DataFileReadSize
+	if iReadSize > stream.Caps.MaxChunk {
+		iReadSize = stream.Caps.MaxChunk
+	}
+	ranges := changedBlocks(fileUpInfo.blocks, blocks, iSize, iReadSize)
+	if len(ranges) == 0 {
+		return errNoChange
+	}
+
+	buf := cBufPool.Get().([]byte)
+	zbuf := zBufPool.Get().([]byte)
+	defer func() {
+		cBufPool.Put(buf)
+		zBufPool.Put(zbuf)
+	}()
+
+	codec, level := pathCodec(stream, fname)
+	var mode uint32
+	var mtime int64
+	for i, r := range ranges {
+		nr, err := file.ReadAt(buf[:r[1]], int64(r[0]))
+		if err != nil || nr != r[1] {
+			return errors.New("file changed when reading blocks")
+		}
+
+		frame := syncf.Frame{Op: syncf.OpWrite, Flags: syncf.FlagSeq | syncf.FlagChecksum | syncf.FlagPatch,
+			Seq: uint32(i + 1), Pos: r[0], TolSize: iSize}
+		last := i == len(ranges)-1
+		if last {
+			frame.Flags |= syncf.FlagDigest
+			frame.Digest = digest
+			if stream.Caps.HasFeature(syncf.FeatureMeta) {
+				setFrameMeta(&frame, fi, clientCfg.GetPathOption(fname).SyncOwner)
+				mode, mtime = frame.Mode, frame.MTime
+			}
+		}
+		if err = PackData(&frame, buf[:nr], fname, codec, level, zbuf); err != nil {
+			return err
+		}
+		throttle(stream.RemoteAddr(), fname, len(frame.Payload))
+		if err = stream.Send(&frame); err != nil {
+			return err
+		}
+		inflight++
+		log.Println("Send patch succeed, pos", r[0], " size", r[1], fname)
+
+		for inflight >= stream.Window || (last && inflight > 0) {
+			var extra time.Duration
+			if last {
+				extra = digestWait(iSize)
+			}
+			rsp, err := stream.RecvWait(extra)
+			if err != nil {
+				return err
+			}
+			if rsp.Op != syncf.OpResult || rsp.Result != syncf.Succeed {
+				return errors.New("patch rejected by server")
+			}
+			inflight--
+		}
+	}
+
+	lFileMap.SetFileBlocks(fname, blocks)
+	if mtime != 0 {
+		lFileMap.SetFileMeta(fname, mode, mtime)
+	} else {
+		lFileMap.SetFileMeta(fname, uint32(fi.Mode()), fi.ModTime().UnixNano())
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"syncfile/syncf"
+)
+
+// upload bandwidth limits shared by all lGPool workers: RateLimit of all
+// uploads, ServerRateLimit of each server addr and RateLimit in
+// LocalPathOption of each monitored path. chunk payload is counted
+
+var (
+	globalLimit  *syncf.RateLimiter
+	serverLimits = make(map[string]*syncf.RateLimiter) // key is server addr
+	pathLimits   = make(map[string]*syncf.RateLimiter) // key is abs local path
+)
+
+func initRateLimits() {
+	globalLimit = syncf.NewRateLimiter(clientCfg.RateLimit, 0)
+	for addr, rate := range clientCfg.ServerRateLimit {
+		if l := syncf.NewRateLimiter(rate, 0); l != nil {
+			serverLimits[addr] = l
+		}
+	}
+	for path, opt := range clientCfg.LPathOptionAbs {
+		if rl := syncf.NewRateLimiter(opt.RateLimit, 0); rl != nil {
+			pathLimits[path] = rl
+		}
+	}
+}
+
+// wait until n bytes of fname can be sent to addr
+func throttle(addr string, fname string, n int) {
+	syncf.WaitRate(n, globalLimit, serverLimits[addr], pathLimits[clientCfg.GetLocalPath(fname)])
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"syncfile/syncf"
+	"time"
+)
+
+// rename event gives the old name, the create event of the new name follows.
+// pair them by inode and size, then rename on server without sending data
+
+const (
+	RenameWaitTime = time.Second
+)
+
+type renameInfo struct {
+	fname string
+	size  int
+	ino   uint64
+	time  time.Time
+}
+
+type RenameMap struct {
+	sync.Mutex
+	Map map[string]*renameInfo // key is old name
+}
+
+var (
+	renameMap = RenameMap{Map: make(map[string]*renameInfo)}
+)
+
+// keep old name for a while, check it as removed if no new name paired
+func (renameMap *RenameMap) AddOld(fname string) {
+	fileUpInfo, isExist := lFileMap.GetFile(fname)
+	if !isExist || fileUpInfo.uploading || len(clientCfg.GetSvrFullPath(fname)) == 0 {
+		uploadQueue.AddFile(fname)
+		return
+	}
+
+	renameMap.Lock()
+	renameMap.Map[fname] = &renameInfo{fname, fileUpInfo.size, fileUpInfo.ino, time.Now()}
+	renameMap.Unlock()
+
+	time.AfterFunc(RenameWaitTime, func() {
+		if renameMap.take(fname) {
+			uploadQueue.AddFile(fname)
+		}
+	})
+}
+
+func (renameMap *RenameMap) take(fname string) bool {
+	renameMap.Lock()
+	defer renameMap.Unlock()
+
+	if _, isExist := renameMap.Map[fname]; isExist {
+		delete(renameMap.Map, fname)
+		return true
+	}
+	return false
+}
+
+// pair new name with the latest old name of same inode and size, true if rename sent
+func (renameMap *RenameMap) PairNew(fname string) bool {
+	fileStat, err := syncf.GetFileStat(fname)
+	if err != nil || len(clientCfg.GetSvrFullPath(fname)) == 0 {
+		return false
+	}
+
+	renameMap.Lock()
+	var old *renameInfo
+	for _, v := range renameMap.Map {
+		if v.size != fileStat.Size || v.ino != fileStat.Ino {
+			continue
+		}
+		if old == nil || v.time.After(old.time) {
+			old = v
+		}
+	}
+	if old != nil {
+		delete(renameMap.Map, old.fname)
+	}
+	renameMap.Unlock()
+
+	if old == nil || !lFileMap.MoveFile(old.fname, fname) {
+		return false
+	}
+
+	if err = putRenamePool(old.fname, fname); err != nil {
+		lFileMap.SetFileUploading(fname, false)
+		uploadQueue.AddFile(old.fname)
+		return false
+	}
+	log.Println("Rename paired", old.fname, fname)
+	return true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syncfile/syncf"
+	"time"
+)
+
+// changed files wait in uploadQueue, ordered by Schedule rules. priority of a
+// file is the highest of PriorityGlobs it matches, or Priority of its path.
+// a glob with "/" is matched with the whole name, others with the base name
+
+var (
+	uploadQueue *syncf.Scheduler
+)
+
+func initUploadQueue() {
+	var err error
+	uploadQueue, err = syncf.NewScheduler(clientCfg.Schedule, time.Duration(clientCfg.MaxWait)*time.Second,
+		filePriority, fileSize)
+	if err != nil {
+		log.Fatal("invalid Schedule ", err)
+	}
+	for pattern := range clientCfg.PriorityGlobs {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			log.Fatal("invalid PriorityGlobs ", pattern, " ", err)
+		}
+	}
+}
+
+func filePriority(fname string) int {
+	prio := clientCfg.GetPathOption(fname).Priority
+	matched := false
+	for pattern, p := range clientCfg.PriorityGlobs {
+		name := filepath.Base(fname)
+		if strings.Contains(pattern, "/") {
+			name = fname
+		}
+		if ok, _ := filepath.Match(pattern, name); ok && (!matched || p > prio) {
+			prio = p
+			matched = true
+		}
+	}
+	return prio
+}
+
+// 0 of a removed file, its delete is sent soon
+func fileSize(fname string) int64 {
+	stat, err := os.Lstat(fname)
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
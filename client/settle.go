@@ -0,0 +1,29 @@
+package main
+
+import (
+	"syncfile/syncf"
+	"time"
+)
+
+// a file changed by events is queued after QuietMs without size or mtime
+// change, or MaxDelayMs after its first event, of its path option
+
+const (
+	settleInterval    = 100 * time.Millisecond
+	DefaultMaxDelayMs = 60000
+)
+
+var (
+	fileSettler = syncf.NewSettler(func(fname string) {
+		uploadQueue.AddFile(fname)
+	})
+)
+
+func settleFile(fname string) {
+	opt := clientCfg.GetPathOption(fname)
+	maxDelay := opt.MaxDelayMs
+	if maxDelay == 0 {
+		maxDelay = DefaultMaxDelayMs
+	}
+	fileSettler.Add(fname, time.Duration(opt.QuietMs)*time.Millisecond, time.Duration(maxDelay)*time.Millisecond)
+}
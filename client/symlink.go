@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syncfile/syncf"
+)
+
+// symlink policy of a monitored path
+const (
+	SymlinkFollow   = "follow"   // upload the target as a file or dir
+	SymlinkPreserve = "preserve" // create the link on server
+	SymlinkSkip     = "skip"
+)
+
+func putLinkPool(fname string, target string) (err error) {
+	err = lGPool.Submit(func() {
+		handLink(fname, target)
+	})
+	if err != nil {
+		log.Println("lGPool.Submit failed")
+	}
+	return err
+}
+
+func handLink(fname string, target string) {
+	strPath := clientCfg.GetSvrFullPath(fname)
+	if len(strPath) == 0 {
+		log.Println("handLink server path get failed", fname)
+		return
+	}
+
+	svrTarget, ok := svrLinkTarget(strPath, target)
+	if !ok {
+		log.Println("handLink target not in monitored path, not sent", fname, target)
+		return
+	}
+
+	frame := syncf.Frame{Op: syncf.OpSymlink, Path: strPath, Payload: []byte(svrTarget)}
+	if fi, err := os.Lstat(fname); err == nil && clientCfg.GetPathOption(fname).SyncOwner {
+		if uid, gid, ok := syncf.FileOwner(fi); ok {
+			frame.Flags |= syncf.FlagOwner
+			frame.Uid, frame.Gid = uid, gid
+		}
+	}
+
+	iRst, err := sendOperation(&frame, syncf.FeatureSymlink)
+	if err != nil || iRst != syncf.Succeed {
+		log.Println("handLink failed ", fname, target, iRst, err)
+		if iRst != syncf.LinkTargetErr {
+			lFileMap.DelFile(fname) // try again on next event
+		}
+		return
+	}
+	log.Println("Symlink succeed", fname, target)
+}
+
+// relative target is sent as is, absolute target must be in a monitored path
+// and is sent relative to the link on server
+func svrLinkTarget(svrLink string, target string) (string, bool) {
+	if !filepath.IsAbs(target) {
+		return filepath.ToSlash(target), true
+	}
+
+	target = filepath.Clean(target)
+	for l, r := range clientCfg.LRPathMapWithPre {
+		if target == l || strings.HasPrefix(target, l+"/") {
+			rel, err := filepath.Rel(path.Dir(svrLink), r+target[len(l):])
+			return filepath.ToSlash(rel), err == nil
+		}
+	}
+	return "", false
+}
+
+// symlink not on server or with other target is sent by change loop
+func checkLinkWithSvr(fname string, link syncf.FileStat, sfiles []syncf.FileStat) {
+	svrTarget, ok := svrLinkTarget(clientCfg.GetSvrFullPath(fname), link.Link)
+	for _, vsf := range sfiles {
+		if ok && vsf.FileName == link.FileName && vsf.Link == svrTarget {
+			lFileMap.SetLink(fname, link.Link)
+			return
+		}
+	}
+	uploadQueue.AddFile(fname)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syncfile/syncf"
+)
+
+// fsnotify watches one dir, so each dir under the monitored paths is watched.
+// dirs created at runtime are added with their tree, removed ones are dropped
+
+type WatchedDirs struct {
+	sync.Mutex
+	Map   map[string]struct{}
+	Links map[string]string // followed symlink to dir, real path of its target
+}
+
+var (
+	watchedDirs = WatchedDirs{Map: make(map[string]struct{}), Links: make(map[string]string)}
+)
+
+// watch root and dirs under it, with queue the files and dirs under root are
+// queued, as a dir moved in has no events of them. a followed symlink to dir
+// is walked and watched as a dir
+func watchTree(root string, queue bool) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	if err = watchDir(root); err != nil {
+		return err
+	}
+	watchSubTree(root, queue)
+	return nil
+}
+
+func watchSubTree(dir string, queue bool) {
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return // removed while walking
+	}
+	for _, info := range list {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		path := dir + "/" + info.Name()
+		if queue {
+			settleFile(path)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !followLink(path) {
+				continue
+			}
+		} else if !info.IsDir() {
+			continue
+		}
+
+		if err = watchDir(path); err != nil {
+			log.Println("fileWatcher.Add failed", path, err)
+			continue
+		}
+		watchSubTree(path, queue)
+	}
+}
+
+func watchDir(path string) error {
+	if err := fileWatcher.Add(path); err != nil {
+		return err
+	}
+	watchedDirs.Lock()
+	watchedDirs.Map[path] = struct{}{}
+	watchedDirs.Unlock()
+	return nil
+}
+
+// true if path is a symlink to dir to walk with follow policy. a target in or
+// over a monitored path or another followed link is not followed, that ends
+// link cycles, and inotify has one name of a watched dir only
+func followLink(path string) bool {
+	if clientCfg.GetPathOption(path).Symlink != SymlinkFollow || !syncf.IsDir(path) {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+
+	watchedDirs.Lock()
+	defer watchedDirs.Unlock()
+	if _, isExist := watchedDirs.Links[path]; isExist {
+		return true
+	}
+	trees := make([]string, 0, len(clientCfg.LRPathMapWithPre)+len(watchedDirs.Links))
+	for l := range clientCfg.LRPathMapWithPre {
+		if dir, err := filepath.EvalSymlinks(l); err == nil {
+			trees = append(trees, dir)
+		}
+	}
+	for _, dir := range watchedDirs.Links {
+		trees = append(trees, dir)
+	}
+	for _, t := range trees {
+		if target == t || strings.HasPrefix(target, t+"/") || strings.HasPrefix(t, target+"/") {
+			log.Println("symlink to dir in synced tree, not followed", path, target)
+			return false
+		}
+	}
+	watchedDirs.Links[path] = target
+	return true
+}
+
+func isFollowedLink(path string) bool {
+	watchedDirs.Lock()
+	defer watchedDirs.Unlock()
+
+	_, isExist := watchedDirs.Links[path]
+	return isExist
+}
+
+// files under root at any depth as syncf.GetTreeFileStat, and the files under
+// the followed symlinks to dirs
+func treeFileStat(root string) []syncf.FileStat {
+	files := syncf.GetTreeFileStat(root)
+	watchedDirs.Lock()
+	var links []string
+	for l := range watchedDirs.Links {
+		if strings.HasPrefix(l, root+"/") {
+			links = append(links, l)
+		}
+	}
+	watchedDirs.Unlock()
+
+	for _, l := range links {
+		for _, sub := range syncf.GetTreeFileStat(l) {
+			sub.FileName = l[len(root)+1:] + "/" + sub.FileName
+			files = append(files, sub)
+		}
+	}
+	return files
+}
+
+// stop watching path and dirs under it, false if path is not a watched dir
+func unwatchTree(path string) bool {
+	watchedDirs.Lock()
+	defer watchedDirs.Unlock()
+
+	if _, isExist := watchedDirs.Map[path]; !isExist {
+		return false
+	}
+	for dir := range watchedDirs.Map {
+		if dir == path || strings.HasPrefix(dir, path+"/") {
+			_ = fileWatcher.Remove(dir) // already gone if removed
+			delete(watchedDirs.Map, dir)
+		}
+	}
+	for link := range watchedDirs.Links {
+		if link == path || strings.HasPrefix(link, path+"/") {
+			delete(watchedDirs.Links, link)
+		}
+	}
+	return true
+}
+
+// new dir is watched, removed or moved out dir is dropped
+func watchEvent(fname string, create bool) {
+	if create {
+		if info, err := os.Lstat(fname); err == nil && (info.IsDir() ||
+			info.Mode()&os.ModeSymlink != 0 && followLink(fname)) {
+			if err = watchTree(fname, true); err != nil {
+				log.Println("watchTree failed", fname, err)
+			}
+		}
+		return
+	}
+	unwatchTree(fname)
+}
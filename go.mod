@@ -4,6 +4,8 @@ go 1.16
 
 require (
 	github.com/fsnotify/fsnotify v1.4.9
+	github.com/klauspost/compress v1.15.15
 	github.com/panjf2000/ants/v2 v2.4.6
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/xtaci/kcp-go/v5 v5.6.1
 )
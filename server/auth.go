@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"syncfile/syncf"
+)
+
+// clients authenticate with OpAuth after hello when Clients is set in config,
+// each one can only write under its PathPrefix
+
+type ClientAuth struct {
+	Token      string `json:"Token"`      // pre-shared token, use with tls
+	Secret     string `json:"Secret"`     // key of hmac challenge-response
+	PathPrefix string `json:"PathPrefix"` // server paths of the client, RemotePathPre of client
+	RateLimit  int    `json:"RateLimit"`  // bytes/s from the client, ClientRateLimit if 0, -1 no limit
+}
+
+func authRequired() bool {
+	return len(svrCfg.Clients) > 0
+}
+
+func checkAuth(auth *syncf.Auth, challenge string) (*ClientAuth, bool) {
+	cli, ok := svrCfg.Clients[auth.ID]
+	if !ok || cli == nil {
+		return nil, false
+	}
+	switch auth.Method {
+	case syncf.AuthMethodToken:
+		return cli, syncf.CheckToken(cli.Token, auth.Proof)
+	case syncf.AuthMethodHMAC:
+		return cli, len(challenge) > 0 && syncf.CheckHMAC(cli.Secret, auth.Proof, []byte(challenge))
+	}
+	return nil, false
+}
+
+// connection is closed after auth failed, pos of the result is the rate limit
+// of the client
+func handleAuth(conInfo *ConInfo) (int, int) {
+	if !authRequired() {
+		return syncf.ReqInvalid, 0
+	}
+	auth, err := syncf.DecodeAuth(conInfo.Req.data)
+	challenge := conInfo.challenge
+	conInfo.challenge = "" // answered once
+	if err != nil {
+		log.Println("syncf.DecodeAuth failed", conInfo.Conn.RemoteAddr(), err)
+		conInfo.Action = Close
+		return syncf.AuthFailed, 0
+	}
+
+	cli, ok := checkAuth(&auth, challenge)
+	if !ok {
+		log.Println("handleAuth failed", auth.ID, auth.Method, conInfo.Conn.RemoteAddr())
+		conInfo.Action = Close
+		return syncf.AuthFailed, 0
+	}
+	conInfo.clientID = auth.ID
+	conInfo.pathPrefix = cli.PathPrefix
+	conInfo.limiter = idLimiter(auth.ID, cli)
+	log.Println("handleAuth", auth.ID, auth.Method, conInfo.Conn.RemoteAddr())
+	return syncf.Succeed, conInfo.limiter.Rate()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syncfile/syncf"
+)
+
+// delta upload of one file: signatures of the old file are sent on OpSigReq,
+// the new file is built in a temp file from the OpDelta ops and replaces the
+// old one when complete
+
+type deltaFile struct {
+	stream    uint32
+	base      *os.File
+	baseSize  int
+	blockSize int
+	tmp       *os.File
+	pos       int               // new file length written
+	digest    *syncf.FileDigest // of the new file written
+}
+
+// signatures are made and sent by a goroutine of their own, a large file does
+// not hold the requests of other streams on the connection. return -1, no result
+func handleSigReq(conInfo *ConInfo) (int, int) {
+	req := &conInfo.Req
+	fileName := req.fileName
+	conInfo.closeDelta(fileName, true)
+
+	rsp := syncf.Frame{Op: syncf.OpSigs}
+	if req.header.flags&syncf.FlagStream != 0 {
+		rsp.Flags |= syncf.FlagStream
+		rsp.Stream = req.header.stream
+	}
+	df, err := newDeltaFile(fileName, req.header.sPos)
+	if err != nil {
+		log.Println("handleSigReq failed", fileName, err)
+		rsp.Result = syncf.FileNotExist
+		conInfo.out, _ = rsp.Encode(conInfo.out)
+		return -1, 0
+	}
+	// the goroutine reads a handle of its own, df may be closed by a stream
+	// end or the connection while the signatures are made
+	sigBase, err := os.Open(fileName)
+	if err != nil {
+		log.Println("handleSigReq failed", fileName, err)
+		df.close(true)
+		rsp.Result = syncf.FileNotExist
+		conInfo.out, _ = rsp.Encode(conInfo.out)
+		return -1, 0
+	}
+	df.stream = req.header.stream
+	if conInfo.deltas == nil {
+		conInfo.deltas = make(map[string]*deltaFile)
+	}
+	conInfo.deltas[fileName] = df
+
+	// the client sends no ops before it gets the signatures. a failed one is
+	// closed with its stream
+	baseSize, blockSize := df.baseSize, df.blockSize
+	go func() {
+		defer sigBase.Close()
+		rsp.Pos = blockSize
+		sig, err := syncf.MakeSignature(sigBase, baseSize, blockSize)
+		var out []byte
+		if err == nil {
+			rsp.Payload = sig.Encode()
+			out, err = rsp.Encode(nil)
+		}
+		if err != nil {
+			log.Println("handleSigReq MakeSignature failed", fileName, err)
+			rsp.Result, rsp.Payload = syncf.FileNotExist, nil
+			out, _ = rsp.Encode(nil)
+		}
+		if err = conInfo.write(out); err != nil {
+			log.Println("handleSigReq Write failed", fileName, conInfo.Conn.RemoteAddr(), err)
+		}
+	}()
+	return -1, 0
+}
+
+func newDeltaFile(fileName string, blockSize int) (*deltaFile, error) {
+	base, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	baseSize, err := syncf.GetFileSize(base)
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	if blockSize < syncf.MinBlockSize || blockSize > syncf.MaxBlockSize {
+		blockSize = syncf.DeltaBlockSize(baseSize)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".delta")
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	return &deltaFile{base: base, baseSize: baseSize, blockSize: blockSize, tmp: tmp, digest: syncf.NewFileDigest()}, nil
+}
+
+func (df *deltaFile) close(remove bool) {
+	_ = df.base.Close()
+	_ = df.tmp.Close()
+	if remove {
+		_ = os.Remove(df.tmp.Name())
+	}
+}
+
+// write delta ops to the temp file, the old file is replaced after the last ops
+func handleDelta(conInfo *ConInfo) (int, int) {
+	req := &conInfo.Req
+	fileName := req.fileName
+	df, ok := conInfo.deltas[fileName]
+	if !ok {
+		log.Println("handleDelta no signature requested", fileName, conInfo.Conn.RemoteAddr())
+		return syncf.ReqInvalid, 0
+	}
+
+	if req.header.flags&syncf.FlagChecksum != 0 && syncf.Checksum(req.data) != req.header.checksum {
+		log.Println("handleDelta checksum mismatch", fileName, req.header.sPos, conInfo.Conn.RemoteAddr())
+		conInfo.closeDelta(fileName, true)
+		return syncf.ChecksumErr, 0
+	}
+	if req.header.sPos != df.pos {
+		log.Println("handleDelta pos mismatch", fileName, req.header.sPos, df.pos)
+		conInfo.closeDelta(fileName, true)
+		return syncf.FilePosErr, df.pos
+	}
+
+	n, err := syncf.ApplyDelta(req.data, df.base, df.baseSize, df.blockSize, io.MultiWriter(df.tmp, df.digest))
+	df.pos += n
+	if err != nil || df.pos > req.header.tolSize {
+		log.Println("handleDelta ApplyDelta failed", fileName, df.pos, req.header.tolSize, err)
+		conInfo.closeDelta(fileName, true)
+		return syncf.FileWriteErr, 0
+	}
+	if df.pos < req.header.tolSize {
+		return syncf.Succeed, df.pos
+	}
+
+	// complete
+	if req.header.flags&syncf.FlagDigest != 0 {
+		if iRst := checkTmpDigest(df, req); iRst != syncf.Succeed {
+			conInfo.closeDelta(fileName, true)
+			return iRst, 0
+		}
+	}
+	if !fileHandleMap.RemoveFreeFileHandleInfo(fileName) {
+		conInfo.closeDelta(fileName, true)
+		return syncf.FileUsing, 0
+	}
+	delete(conInfo.deltas, fileName)
+	df.close(false)
+	if err = os.Rename(df.tmp.Name(), fileName); err != nil {
+		log.Println("handleDelta Rename failed", fileName, err)
+		_ = os.Remove(df.tmp.Name())
+		return syncf.FileWriteErr, 0
+	}
+	applyMeta(fileName, &req.header)
+	log.Println("handleDelta", fileName, df.pos, conInfo.Conn.RemoteAddr())
+	return syncf.Succeed, df.pos
+}
+
+func checkTmpDigest(df *deltaFile, req *Request) int {
+	if sum, _ := df.digest.Sum(); df.digest.Size() != df.pos || !bytes.Equal(sum, req.header.digest) {
+		log.Println("handleDelta sha256 mismatch", df.tmp.Name())
+		return syncf.DigestErr
+	}
+	return syncf.Succeed
+}
+
+func (conInfo *ConInfo) closeDelta(fileName string, remove bool) {
+	if df, ok := conInfo.deltas[fileName]; ok {
+		delete(conInfo.deltas, fileName)
+		df.close(remove)
+	}
+}
+
+// delta not complete when its stream ends
+func (conInfo *ConInfo) closeStreamDeltas(stream uint32) {
+	for k, df := range conInfo.deltas {
+		if df.stream == stream {
+			conInfo.closeDelta(k, true)
+		}
+	}
+}
+
+func (conInfo *ConInfo) closeDeltas() {
+	for k := range conInfo.deltas {
+		conInfo.closeDelta(k, true)
+	}
+}
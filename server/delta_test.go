@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syncfile/syncf"
+	"testing"
+)
+
+// delta of a file against the server copy, with the stream ended before the
+// signatures are sent the delta is dropped and the old file kept
+func TestHandleDelta(t *testing.T) {
+	root, cn := startTestServer(t)
+	rnd := rand.New(rand.NewSource(1))
+	errRejected := errors.New("delta rejected")
+
+	for i, c := range []struct {
+		name      string
+		streamEnd bool // before the signatures are read
+		rst       int  // of the delta ops
+	}{
+		{"complete", false, syncf.Succeed},
+		{"stream end while making signatures", true, syncf.ReqInvalid},
+	} {
+		old := make([]byte, 4<<20)
+		rnd.Read(old)
+		cur := append(append([]byte(nil), old[:1<<20]...), []byte("changed")...)
+		cur = append(cur, old[1<<20:]...)
+		path := "/c1/d" + strconv.Itoa(i)
+		fileName := filepath.Join(root, filepath.FromSlash(path))
+		if err := ioutil.WriteFile(fileName, old, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		stream := uint32(i + 1)
+		req := syncf.Frame{Op: syncf.OpSigReq, Flags: syncf.FlagStream, Stream: stream, Path: path,
+			Pos: syncf.DeltaBlockSize(len(old))}
+		sendFrame(t, cn, &req)
+		if c.streamEnd {
+			end := syncf.Frame{Op: syncf.OpStreamEnd, Flags: syncf.FlagStream, Stream: stream}
+			sendFrame(t, cn, &end)
+		}
+		rsp := recvFrame(t, cn)
+		if rsp.Op != syncf.OpSigs || rsp.Result != syncf.Succeed || rsp.Stream != stream {
+			t.Fatal(c.name, "signatures", rsp.Op, rsp.Result, rsp.Stream)
+		}
+		sig, err := syncf.DecodeSignature(rsp.Payload)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		sum := sha256.Sum256(cur)
+		pos, rst := 0, syncf.Succeed
+		_, err = syncf.GenDelta(sig, bytes.NewReader(cur), 64*1024, func(ops []byte, n int) error {
+			frame := syncf.Frame{Op: syncf.OpDelta, Flags: syncf.FlagStream | syncf.FlagChecksum, Stream: stream,
+				Path: path, Pos: pos, TolSize: len(cur), Payload: ops, Checksum: syncf.Checksum(ops)}
+			if pos+n == len(cur) {
+				frame.Flags |= syncf.FlagDigest
+				frame.Digest = sum[:]
+			}
+			sendFrame(t, cn, &frame)
+			if rsp := recvFrame(t, cn); rsp.Op != syncf.OpResult || rsp.Result != syncf.Succeed {
+				rst = rsp.Result
+				return errRejected
+			}
+			pos += n
+			return nil
+		})
+		if rst != c.rst {
+			t.Fatal(c.name, "delta result", rst, "want", c.rst, err)
+		}
+
+		want := cur
+		if c.rst != syncf.Succeed {
+			want = old
+		}
+		if data, err := ioutil.ReadFile(fileName); err != nil || !bytes.Equal(data, want) {
+			t.Fatal(c.name, "content not as wanted", len(data), err)
+		}
+		list, _ := ioutil.ReadDir(filepath.Dir(fileName))
+		for _, fi := range list {
+			if strings.Contains(fi.Name(), ".delta") {
+				t.Fatal(c.name, "temp file left", fi.Name())
+			}
+		}
+	}
+}
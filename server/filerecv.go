@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"strconv"
+	"path/filepath"
 	"sync"
 	"syncfile/syncf"
 	"time"
@@ -15,33 +17,66 @@ import (
 type Request struct {
 	header      ReqHeader
 	data        []byte
+	body        io.Reader // payload of OpWrite not read yet, nil for other ops
+	fileName    string    // local name of header.filePath
 }
 
 type ReqHeader struct {
+	op          uint8
+	flags       uint16
 	filePath    string
 	sPos        int
 	size        int
 	tolSize     int
 	comprs      bool
+	codec       uint8 // id of compression codec
+	checksum    uint32
+	digest      []byte
+	seq         uint32
+	stream      uint32
+	mode        uint32
+	mtime       int64
+	uid         int
+	gid         int
 }
 
 type ConInfo struct {
-	in     []byte
+	in     []byte // frame header
 	out    []byte
 	Conn   net.Conn
+	wlk    sync.Mutex // signatures are written by their own goroutine
+	rd     *bufio.Reader
 	Req    Request
 	Action      int //是否关闭连接
+	Caps   syncf.Hello // negotiated with client
+	streams map[uint32]struct{} // open streams of a mux client
+	deltas map[string]*deltaFile // delta uploads in progress, key is file name
+	challenge  string // sent in hello ack, not answered yet
+	idle       time.Duration // read timeout, kcp session is never closed by peer
+	limiter    *syncf.RateLimiter // ingress of the client, nil no limit
+	clientID   string // authenticated client
+	pathPrefix string // server paths of the client
+	legacy     bool // text protocol of a client before frames
 }
 
-var bufPool = sync.Pool{
+// chunk data without checksum is copied from connection to file through small
+// buffers, the memory of a connection not depends on the chunk size
+var copyBufPool = sync.Pool{
 	New: func() interface{} {
-		return make([]byte, 20*1024*1024)
+		return make([]byte, CopyBufSize)
 	},
 }
 
-func putHandlePool(conn net.Conn) (err error) {
+// a checked chunk before written, up to MaxChunkSize
+var chunkBufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func putHandlePool(conn net.Conn, idle time.Duration) (err error) {
 	err = grPool.Submit(func() {
-		handleNewConn(conn)
+		handleNewConn(conn, idle)
 	})
 	if err != nil {
 		log.Println("grPool.Submit failed")
@@ -49,194 +84,569 @@ func putHandlePool(conn net.Conn) (err error) {
 	return err
 }
 
-func handleNewConn(conn net.Conn) {
-	buf := bufPool.Get().([]byte)
+func handleNewConn(conn net.Conn, idle time.Duration) {
 	defer func() {
-		bufPool.Put(buf)
 		log.Println("Close connection after handleNewConn", conn.RemoteAddr())
 		_ = conn.Close()
 	}()
 
 	var conInfo ConInfo
 	conInfo.Conn = conn
+	conInfo.idle = idle
+	conInfo.limiter = hostLimiter(conn)
+	conInfo.rd = bufio.NewReaderSize(rateReader{&conInfo}, ReadBufSize)
+	defer conInfo.closeDeltas()
+	conInfo.Caps = syncf.LegacyHello // client without hello
+	var err error
+	if conInfo.idle > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(conInfo.idle))
+	}
+	if conInfo.legacy, err = isLegacyConn(&conInfo); err != nil {
+		log.Println(err, conn.RemoteAddr())
+		return
+	}
 	for {
-		nr, err := conn.Read(buf[:cap(buf)])
-		if err != nil {
-			log.Println(err, conn.RemoteAddr())
+		handleData(&conInfo)
+		if conInfo.Action == Close {
 			return
 		}
+	}
+}
 
-		buf = buf[0:nr]
-		handleData(&conInfo, buf)
-		if conInfo.Action == Close {
+// read and handle one request
+func handleData(conInfo *ConInfo) {
+	req := &conInfo.Req
+	req.Reset()
+	conInfo.out = conInfo.out[0:0]
+	conInfo.Action = None
+	if conInfo.idle > 0 {
+		_ = conInfo.Conn.SetReadDeadline(time.Now().Add(conInfo.idle))
+	}
+	var iRst int
+	if conInfo.legacy {
+		iRst = readLegacyReq(conInfo)
+	} else {
+		iRst = readReq(conInfo)
+	}
+	if iRst < 0 {
+		conInfo.Action = Close
+		return
+	}
+
+	iPos := 0
+	if iRst == 2 {
+		log.Println("readReq invalid request", conInfo.Conn.RemoteAddr())
+		iRst = syncf.ReqInvalid
+	} else {
+		iRst, iPos = handleRequest(conInfo)
+	}
+
+	// chunk data not used by a failed request
+	if req.body != nil {
+		if _, err := io.Copy(ioutil.Discard, req.body); err != nil {
+			log.Println("Read failed", conInfo.Conn.RemoteAddr(), err)
+			conInfo.Action = Close
 			return
 		}
+	}
 
+	if iRst >= 0 && conInfo.legacy {
+		buildLegacyRsp(iRst, iPos, conInfo)
+	} else if iRst >= 0 {
+		BuildRspData(iRst, iPos, conInfo)
 	}
-}
 
-func handleData(conInfo *ConInfo, buf []byte) {
-	req := &conInfo.Req
-	data := conInfo.Begin(buf)
-	for {
-		req.Reset()
-		conInfo.out = conInfo.out[0:0]
-		conInfo.Action = None
-		iRst, leftover := parseReq(data, req)
-		if iRst < 0 {
-			log.Println("parseReq failed", iRst)
+	if len(conInfo.out) > 0 {
+		err := conInfo.write(conInfo.out)
+		if err != nil {
+			log.Println("Write failed", conInfo.Conn.RemoteAddr(), err)
 			conInfo.Action = Close
-			break
+			return
 		}
+		conInfo.out = conInfo.out[:0]
+	}
+}
+
+func (conInfo *ConInfo) write(out []byte) error {
+	conInfo.wlk.Lock()
+	defer conInfo.wlk.Unlock()
+	err := conInfo.Conn.SetWriteDeadline(time.Now().Add(time.Second*ReadWriteDeadLine))
+	if err != nil {
+		return err
+	}
+	_, err = conInfo.Conn.Write(out)
+	return err
+}
 
-		if iRst == 1 {
-			break
+// read header of one frame, the payload of OpWrite is left on connection as req.body,
+// others are read into req.data.
+// -1 failed, 0 succeed, 2 invalid request and skipped
+func readReq(conInfo *ConInfo) int {
+	req := &conInfo.Req
+	var frame syncf.Frame
+	var plen int
+	var err error
+	conInfo.in, plen, err = syncf.ReadFrameHeader(conInfo.rd, &frame, conInfo.in)
+	if err == syncf.ErrFrameFormat {
+		if _, err = io.CopyN(ioutil.Discard, conInfo.rd, int64(plen)); err != nil {
+			log.Println(err, conInfo.Conn.RemoteAddr())
+			return -1
 		}
+		return 2
+	}
+	if err != nil {
+		log.Println(err, conInfo.Conn.RemoteAddr())
+		return -1
+	}
+
+	req.header.op = frame.Op
+	req.header.flags = frame.Flags
+	req.header.filePath = frame.Path
+	req.header.sPos = frame.Pos
+	req.header.size = plen
+	req.header.tolSize = frame.TolSize
+	req.header.comprs = frame.Flags&syncf.FlagCompress != 0
+	req.header.codec = syncf.CodecIDGzip
+	if frame.Flags&syncf.FlagCodec != 0 {
+		req.header.codec = frame.Codec
+	}
+	req.header.checksum = frame.Checksum
+	req.header.digest = append(req.header.digest[:0], frame.Digest...)
+	req.header.seq = frame.Seq
+	req.header.stream = frame.Stream
+	req.header.mode = frame.Mode
+	req.header.mtime = frame.MTime
+	req.header.uid = frame.Uid
+	req.header.gid = frame.Gid
+
+	if frame.Op == syncf.OpWrite {
+		req.body = io.LimitReader(conInfo.rd, int64(plen))
+		return 0
+	}
+	if plen > svrCfg.MaxChunkSize {
+		log.Println("readReq payload too long", frame.Op, plen, conInfo.Conn.RemoteAddr())
+		return -1
+	}
+	if cap(req.data) < plen {
+		req.data = make([]byte, plen)
+	}
+	req.data = req.data[:plen]
+	if _, err = io.ReadFull(conInfo.rd, req.data); err != nil {
+		log.Println(err, conInfo.Conn.RemoteAddr())
+		return -1
+	}
+	return 0
+}
 
+func handleRequest(conInfo *ConInfo) (int, int) {
+	req := &conInfo.Req
+	if req.header.op == syncf.OpHello {
+		return handleHello(conInfo)
+	}
+	if req.header.op == syncf.OpAuth {
+		return handleAuth(conInfo)
+	}
+	if authRequired() && len(conInfo.clientID) == 0 {
+		log.Println("handleRequest not authenticated", req.header.op, conInfo.Conn.RemoteAddr())
+		conInfo.Action = Close
+		return syncf.AuthFailed, 0
+	}
 
-		if req.header.comprs {
-			req.data = syncf.GzipUnCompress(req.data)
+	if req.header.flags&syncf.FlagStream != 0 {
+		if req.header.op == syncf.OpStreamEnd {
+			delete(conInfo.streams, req.header.stream)
+			conInfo.closeStreamDeltas(req.header.stream)
+			return -1, 0
+		}
+		if !conInfo.openStream(req.header.stream) {
+			log.Println("handleRequest too many streams", len(conInfo.streams), conInfo.Conn.RemoteAddr())
+			return syncf.StreamLimit, 0
 		}
+	}
 
-		iPos := 0
-		iRst, iPos = handleOperation(conInfo)
-		BuildRspData(iRst, iPos, conInfo)
+	if len(req.header.filePath) == 0 {
+		return syncf.ReqInvalid, 0
+	}
+	var iRst int
+	if req.fileName, iRst = conInfo.resolvePath(req.header.filePath); iRst != syncf.Succeed {
+		return iRst, 0
+	}
 
-		if len(conInfo.out) > 0 {
-			err := conInfo.Conn.SetWriteDeadline(time.Now().Add(time.Second*ReadWriteDeadLine))
-			if err != nil {
-				log.Println("SetWriteDeadline failed", conInfo.Conn.RemoteAddr(), err)
-				conInfo.Action = Close
-				return
-			}
-			_, err = conInfo.Conn.Write(conInfo.out)
-			if err != nil {
-				log.Println("Write failed", conInfo.Conn.RemoteAddr(), err)
-				conInfo.Action = Close
-				return
-			}
-			conInfo.out = conInfo.out[:0]
+	switch req.header.op {
+	case syncf.OpWrite:
+		return handleWrite(conInfo)
+	case syncf.OpDelete:
+		return handleDelete(conInfo), 0
+	case syncf.OpRename:
+		return handleRename(conInfo), 0
+	case syncf.OpMkdir:
+		return handleMkdir(conInfo), 0
+	case syncf.OpRmdir:
+		return handleRmdir(conInfo), 0
+	case syncf.OpSetMeta:
+		return handleSetMeta(conInfo), 0
+	case syncf.OpSymlink:
+		return handleSymlink(conInfo), 0
+	case syncf.OpSigReq:
+		return handleSigReq(conInfo)
+	case syncf.OpDelta:
+		return handleDelta(conInfo)
+	default:
+		log.Println("handleRequest unknown op", req.header.op, conInfo.Conn.RemoteAddr())
+		return syncf.ReqInvalid, 0
+	}
+}
+
+// chunk data is decompressed and checked while written to file
+func handleWrite(conInfo *ConInfo) (int, int) {
+	req := &conInfo.Req
+	body := req.body
+	if req.header.comprs {
+		codec := syncf.GetCodecByID(req.header.codec)
+		if codec == nil {
+			log.Println("handleRequest codec not support", req.header.codec, conInfo.Conn.RemoteAddr())
+			return syncf.ReqInvalid, 0
 		}
+		dec, err := codec.NewReader(body)
+		if err != nil {
+			log.Println("handleRequest decompress failed", codec.Name(), req.header.filePath, err)
+			return syncf.ReqInvalid, 0
+		}
+		defer dec.Close()
+		body = dec
+	}
+	body = syncf.LimitReader(body, conInfo.Caps.MaxChunk)
+
+	// a checked chunk is read whole and verified before it touches the file,
+	// so is a patch chunk written in place. chunks without checksum of old
+	// clients are streamed to the file
+	checked := req.header.flags&(syncf.FlagChecksum|syncf.FlagPatch) != 0
+	var chunk *bytes.Buffer
+	if checked {
+		chunk = chunkBufPool.Get().(*bytes.Buffer)
+		chunk.Reset()
+		defer chunkBufPool.Put(chunk)
+		if _, err := chunk.ReadFrom(syncf.LimitReader(body, svrCfg.MaxChunkSize)); err != nil {
+			log.Println("handleRequest read chunk failed", req.header.filePath, req.header.sPos, err, conInfo.Conn.RemoteAddr())
+			return syncf.ReqInvalid, 0
+		}
+		if req.header.flags&syncf.FlagChecksum != 0 && syncf.Checksum(chunk.Bytes()) != req.header.checksum {
+			log.Println("handleRequest checksum mismatch", req.header.filePath, req.header.sPos, conInfo.Conn.RemoteAddr())
+			return syncf.ChecksumErr, 0
+		}
+		body = chunk
+	}
 
-		data = leftover
-		if len(data) == 0 {
-			break
+	var iRst, iPos int
+	if req.header.flags&syncf.FlagPatch != 0 {
+		iRst, iPos = handlePatch(conInfo, chunk.Bytes())
+	} else {
+		buf := copyBufPool.Get().([]byte)
+		defer copyBufPool.Put(buf)
+		iRst, iPos = handleOperation(conInfo, body, buf)
+	}
+	if iRst == syncf.ReqInvalid {
+		log.Println("handleRequest read chunk failed", req.header.filePath, req.header.sPos, conInfo.Conn.RemoteAddr())
+	}
+	if iRst != syncf.Succeed {
+		if !checked {
+			undoWrite(conInfo)
 		}
+		return iRst, iPos
+	}
 
+	if req.header.flags&syncf.FlagDigest != 0 {
+		iRst = checkDigest(conInfo)
+	}
+	if iRst == syncf.Succeed {
+		applyMeta(req.fileName, &req.header)
 	}
-	conInfo.End(data)
+	return iRst, iPos
 }
 
-// -1 failed, 0 succeed, 1 not enough
-// ture header complete
-// path pos size tsize ndata
-func parseReq(buf []byte, req *Request) (int, []byte) {
-	leftover := buf[0:]
-	iHEnd := bytes.IndexByte(buf, '\n')
-	if iHEnd < 0 {
-		return 1, leftover
+// data of a failed chunk streamed without checksum is cut
+func undoWrite(conInfo *ConInfo) {
+	req := &conInfo.Req
+	if req.header.flags&syncf.FlagPatch != 0 {
+		return
+	}
+	fileName := req.fileName
+	stat, err := os.Lstat(fileName)
+	if err != nil || !stat.Mode().IsRegular() || int(stat.Size()) <= req.header.sPos {
+		return
+	}
+	if !fileHandleMap.RemoveFreeFileHandleInfo(fileName) {
+		return // written by another request
 	}
+	if err = os.Truncate(fileName, int64(req.header.sPos)); err != nil {
+		log.Println("undoWrite Truncate failed", fileName, err)
+	}
+}
 
-	strHead := string(buf[0:iHEnd])
-	iRst, err := fmt.Sscanf(strHead, "%s %d %d %d %t", &req.header.filePath,
-		&req.header.sPos, &req.header.size, &req.header.tolSize, &req.header.comprs)
-	if iRst != 5 || err != nil {
-		return -1, leftover
+// remove file, succeed if already not exist
+func handleDelete(conInfo *ConInfo) int {
+	fileName := conInfo.Req.fileName
+	if !fileHandleMap.RemoveFreeFileHandleInfo(fileName) {
+		return syncf.FileUsing
 	}
 
-	if req.header.sPos < 0 || req.header.size < 0 || req.header.tolSize < 0 {
-		return -1, leftover
+	stat, err := os.Lstat(fileName)
+	if os.IsNotExist(err) {
+		return syncf.Succeed
+	}
+	if err != nil || stat.IsDir() {
+		log.Println("handleDelete not a file", fileName, err)
+		return syncf.FileRemoveErr
 	}
 
-	iData := len(buf)-iHEnd-1
-	if req.header.size > iData {
-		return 1, leftover
+	if err = os.Remove(fileName); err != nil {
+		log.Println("handleDelete Remove failed", fileName, err)
+		return syncf.FileRemoveErr
 	}
+	log.Println("handleDelete", fileName, conInfo.Conn.RemoteAddr())
+	return syncf.Succeed
+}
 
-	iEnd := iHEnd+1+req.header.size
+// move file to the new path in payload
+func handleRename(conInfo *ConInfo) int {
+	req := &conInfo.Req
+	if len(req.data) == 0 || len(req.data) > syncf.MaxFramePath {
+		return syncf.ReqInvalid
+	}
+	oldName := req.fileName
+	newName, iRst := conInfo.resolvePath(string(req.data))
+	if iRst != syncf.Succeed {
+		return iRst
+	}
 
-	if len(buf) > iEnd{
-		req.data = append(req.data, buf[iHEnd+1:iEnd]...)
-		leftover = buf[iEnd:]
-		return 0, leftover
-	} else {
-		req.data = append(req.data, buf[iHEnd+1:]...)
-		return 0, nil
-	}
-
-	// speed up
-	//leftover := buf[0:]
-	//nPath := bytes.IndexByte(buf, ' ')
-	//if nPath < 0 {
-	//	return 1, leftover
-	//}
-	//
-	//nPos := bytes.IndexByte(buf[nPath+1:], ' ')
-	//if nPos < 0 {
-	//	return 1, leftover
-	//}
-	//
-	//nSize := bytes.IndexByte(buf[nPos+1:], ' ')
-	//if nSize < 0 {
-	//	return 1, leftover
-	//}
-	//
-	//nTsize := bytes.IndexByte(buf[nSize+1:], ' ')
-	//if nTsize < 0 {
-	//	return 1, leftover
-	//}
-	//
-	//nComprs := bytes.IndexByte(buf[nTsize+1:], ' ')
-	//if nTsize < 0 {
-	//	return 1, leftover
-	//}
-	//
-	//iData := len(buf)-nComprs-1
-	//if req.header.size > iData {
-	//	return 1, leftover
-	//}
-	//
-	//req.header.filePath = string(buf[:nPath])
-	//req.header.sPos, _ = strconv.Atoi(string(buf[nPath+1:nPos]))
-	//req.header.size, _ = strconv.Atoi(string(buf[nPos+1:nSize]))
-	//req.header.tolSize, _ = strconv.Atoi(string(buf[nSize+1:nTsize]))
-	//if i,_ := strconv.Atoi(string(buf[nTsize+1:nComprs])); i > 0 {
-	//	req.header.comprs = true
-	//}
+	stat, err := os.Lstat(oldName)
+	if err != nil {
+		log.Println("handleRename old file not exist", oldName, err)
+		return syncf.FileNotExist
+	}
+	if stat.IsDir() {
+		log.Println("handleRename not a file", oldName)
+		return syncf.ReqInvalid
+	}
+
+	if !fileHandleMap.RemoveFreeFileHandleInfo(oldName) || !fileHandleMap.RemoveFreeFileHandleInfo(newName) {
+		return syncf.FileUsing
+	}
+	syncf.CreateFilePathF(newName)
+	if err = os.Rename(oldName, newName); err != nil {
+		log.Println("handleRename Rename failed", oldName, newName, err)
+		return syncf.FileWriteErr
+	}
+	log.Println("handleRename", oldName, newName, conInfo.Conn.RemoteAddr())
+	return syncf.Succeed
+}
+
+func handleMkdir(conInfo *ConInfo) int {
+	path := conInfo.Req.fileName
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		log.Println("handleMkdir MkdirAll failed", path, err)
+		return syncf.FieleCreateErr
+	}
+	applyMeta(path, &conInfo.Req.header)
+	log.Println("handleMkdir", path, conInfo.Conn.RemoteAddr())
+	return syncf.Succeed
 }
 
+// remove directory with all files in it, succeed if already not exist
+func handleRmdir(conInfo *ConInfo) int {
+	path := conInfo.Req.fileName
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return syncf.Succeed
+	}
+	if err != nil || !stat.IsDir() {
+		log.Println("handleRmdir not a dir", path, err)
+		return syncf.FileRemoveErr
+	}
+
+	if !fileHandleMap.RemovePathFileHandleInfo(path) {
+		return syncf.FileUsing
+	}
+	if err = os.RemoveAll(path); err != nil {
+		log.Println("handleRmdir RemoveAll failed", path, err)
+		return syncf.FileRemoveErr
+	}
+	log.Println("handleRmdir", path, conInfo.Conn.RemoteAddr())
+	return syncf.Succeed
+}
 
-func (conn *ConInfo) Begin(packet []byte) (data []byte) {
-	data = packet
-	if len(conn.in) > 0 {
-		conn.in = append(conn.in, data...)
-		data = conn.in
+// meta changed without file data
+func handleSetMeta(conInfo *ConInfo) int {
+	fileName := conInfo.Req.fileName
+	if _, err := os.Lstat(fileName); err != nil {
+		log.Println("handleSetMeta file not exist", fileName, err)
+		return syncf.FileNotExist
 	}
-	return data
+	applyMeta(fileName, &conInfo.Req.header)
+	return syncf.Succeed
 }
 
-func (conn *ConInfo) End(data []byte) {
-	if len(data) > 0 {
-		if len(data) != len(conn.in) {
-			conn.in = append(conn.in[:0], data...)
+// create symlink to target in payload, target must be relative and stay inside LRPath
+func handleSymlink(conInfo *ConInfo) int {
+	req := &conInfo.Req
+	target := string(req.data)
+	linkName := req.fileName
+	// target followed through the links already there, a chain of links
+	// each in the client dir can still lead out of it
+	root, err := clientRoot(conInfo.pathPrefix)
+	if err == nil {
+		err = root.CheckLink(linkName, target)
+	}
+	if err != nil {
+		log.Println("handleSymlink target not allowed", linkName, target, err, conInfo.Conn.RemoteAddr())
+		return syncf.LinkTargetErr
+	}
+
+	stat, err := os.Lstat(linkName)
+	if err == nil && stat.IsDir() {
+		log.Println("handleSymlink dir exist", linkName)
+		return syncf.FieleCreateErr
+	}
+
+	// replace old file or link at once
+	if !fileHandleMap.RemoveFreeFileHandleInfo(linkName) {
+		return syncf.FileUsing
+	}
+	syncf.CreateFilePathF(linkName)
+	tmpName := filepath.Join(filepath.Dir(linkName), "."+filepath.Base(linkName)+".symlink")
+	_ = os.Remove(tmpName)
+	if err = os.Symlink(target, tmpName); err != nil {
+		log.Println("handleSymlink Symlink failed", linkName, err)
+		return syncf.FieleCreateErr
+	}
+	if err = os.Rename(tmpName, linkName); err != nil {
+		log.Println("handleSymlink Rename failed", linkName, err)
+		_ = os.Remove(tmpName)
+		return syncf.FieleCreateErr
+	}
+
+	if req.header.flags&syncf.FlagOwner != 0 {
+		uid, gid := svrCfg.MapOwner(req.header.uid, req.header.gid)
+		if err = os.Lchown(linkName, uid, gid); err != nil {
+			log.Println("handleSymlink Lchown failed", linkName, err)
 		}
-	} else if len(conn.in) > 0 {
-		conn.in = conn.in[:0]
 	}
+	log.Println("handleSymlink", linkName, target, conInfo.Conn.RemoteAddr())
+	return syncf.Succeed
 }
 
-func handleOperation(conInfo *ConInfo) (int, int){
+// set mode, owner and mtime sent with the last chunk, failure only logged
+func applyMeta(fileName string, header *ReqHeader) {
+	if header.flags&syncf.FlagMeta != 0 {
+		mode := os.FileMode(header.mode) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(fileName, mode); err != nil {
+			log.Println("applyMeta Chmod failed", fileName, err)
+		}
+	}
+
+	if header.flags&syncf.FlagOwner != 0 {
+		uid, gid := svrCfg.MapOwner(header.uid, header.gid)
+		if err := os.Lchown(fileName, uid, gid); err != nil {
+			log.Println("applyMeta Lchown failed", fileName, uid, gid, err)
+		}
+	}
+
+	// last, chmod and chown not change mtime
+	if header.flags&syncf.FlagMeta != 0 && header.mtime > 0 {
+		mtime := time.Unix(0, header.mtime)
+		if err := os.Chtimes(fileName, mtime, mtime); err != nil {
+			log.Println("applyMeta Chtimes failed", fileName, err)
+		}
+	}
+}
+
+// whole file size and sha256 check on the last chunk. the digest kept on the
+// file handle is extended, the file is read from start only if its data was not
+// written through the handle
+func checkDigest(conInfo *ConInfo) int {
+	req := &conInfo.Req
+	fileName := req.fileName
+	digest := syncf.NewFileDigest()
+	if iRst, fileInfo := fileHandleMap.GetFileHandleInfo(fileName); iRst == syncf.FileInfoCanUse {
+		if fileInfo.Digest == nil {
+			fileInfo.Digest = digest
+		}
+		digest = fileInfo.Digest
+		defer fileHandleMap.PutFileHandleInfo(fileInfo)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		log.Println("checkDigest open failed", fileName, err)
+		return syncf.FileNotExist
+	}
+	defer file.Close()
+
+	iSize, err := syncf.GetFileSize(file)
+	if err != nil || iSize != req.header.tolSize {
+		log.Println("checkDigest size mismatch", fileName, iSize, req.header.tolSize, err)
+		return syncf.DigestErr
+	}
+
+	if err = digest.Update(file, iSize); err != nil {
+		log.Println("checkDigest read failed", fileName, err)
+		return syncf.DigestErr
+	}
+	if sum, _ := digest.Sum(); !bytes.Equal(sum, req.header.digest) {
+		log.Println("checkDigest sha256 mismatch", fileName)
+		return syncf.DigestErr
+	}
+	return syncf.Succeed
+}
+
+// record stream of client, false if the connection has too many streams
+func (conInfo *ConInfo) openStream(id uint32) bool {
+	if conInfo.streams == nil {
+		conInfo.streams = make(map[uint32]struct{})
+	}
+	if _, ok := conInfo.streams[id]; ok {
+		return true
+	}
+	if len(conInfo.streams) >= conInfo.Caps.MaxStreams {
+		return false
+	}
+	conInfo.streams[id] = struct{}{}
+	return true
+}
+
+// reply hello ack directly, return -1 if no result need
+func handleHello(conInfo *ConInfo) (int, int) {
+	remote, err := syncf.DecodeHello(conInfo.Req.data)
+	if err != nil {
+		log.Println("syncf.DecodeHello failed", conInfo.Conn.RemoteAddr(), err)
+		return syncf.ReqInvalid, 0
+	}
+
+	conInfo.Caps = syncf.NegotiateHello(svrHello, remote)
+	log.Println("Hello from", conInfo.Conn.RemoteAddr(), "version", remote.Version, "negotiated", conInfo.Caps)
+	ackHello := conInfo.Caps
+	if authRequired() {
+		if conInfo.challenge, err = syncf.NewChallenge(); err != nil {
+			log.Println("syncf.NewChallenge failed", err)
+			return syncf.ReqInvalid, 0
+		}
+		ackHello.Challenge = conInfo.challenge
+	}
+	ackHello.RateLimit = conInfo.limiter.Rate() // client deadlines allow for it
+
+	ack := syncf.Frame{Op: syncf.OpHelloAck, Payload: ackHello.Encode()}
+	conInfo.out, _ = ack.Encode(conInfo.out) // no path
+	return -1, 0
+}
+
+func handleOperation(conInfo *ConInfo, body io.Reader, buf []byte) (int, int){
 	req := &conInfo.Req
 	var fileName string
 	var file *os.File
 	var err error
 	iRst := 0
 	nw := 0
-	if req.header.filePath[0] != '/' {
-		fileName = svrCfg.LRPath + "/" + req.header.filePath
-	} else {
-		fileName = svrCfg.LRPath + req.header.filePath
-	}
+	fileName = req.fileName
 
 	bFileExist := syncf.CheckFileIsExist(fileName)
 	if !bFileExist {
@@ -245,8 +655,11 @@ func handleOperation(conInfo *ConInfo) (int, int){
 
 	// new file
 	if req.header.sPos == 0 {
+		if stat, err := os.Lstat(fileName); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			bFileExist = true // not write to the link target
+		}
 		iRst, _ = fileHandleMap.GetFileHandleInfo(fileName)
-		if iRst == syncf.FileUsing {
+		if iRst == syncf.FileInfoUsing {
 			return syncf.FileUsing, 0
 		} else if iRst == syncf.FileInfoCanUse {
 			fileHandleMap.RemoveFileHandleInfo(fileName)
@@ -267,15 +680,16 @@ func handleOperation(conInfo *ConInfo) (int, int){
 			return syncf.FieleCreateErr, 0
 		}
 
-		//write data
-		nw, err = file.Write(req.data)
-		if err != nil {
-			log.Println("Wirte failed ", fileName, err)
+		//write data, hashed for the digest check
+		digest := syncf.NewFileDigest()
+		iRst, nw = syncf.CopyAt(file, 0, io.TeeReader(body, digest), buf)
+		if iRst != syncf.Succeed {
+			log.Println("Wirte failed ", fileName, iRst)
 			file.Close()
-			return syncf.FileWriteErr, 0
+			return iRst, 0
 		}
 
-		fileHandleMap.AddFileHandleInfo(fileName, file)
+		fileHandleMap.AddFileHandleDigest(fileName, file, digest)
 		return syncf.Succeed, nw
 	}
 
@@ -297,9 +711,9 @@ func handleOperation(conInfo *ConInfo) (int, int){
 			return syncf.FieleCreateErr, 0
 		}
 
-		iRst, nw = syncf.CheckPosAndWrte(file, req.header.sPos, req.data)
+		iRst, nw = syncf.CheckPosAndCopy(file, req.header.sPos, body, buf)
 		if iRst != syncf.Succeed {
-			log.Println("syncf.CheckPosAndWrte failed reqpos", req.header.sPos, iRst, fileName)
+			log.Println("syncf.CheckPosAndCopy failed reqpos", req.header.sPos, iRst, fileName)
 			file.Close()
 			return iRst, nw
 		}
@@ -308,10 +722,16 @@ func handleOperation(conInfo *ConInfo) (int, int){
 		return iRst, nw
 	}
 
+	// appended data extends the digest, a rewrite drops it
 	file = fileInfo.File
-	iRst, nw = syncf.CheckPosAndWrte(file, req.header.sPos, req.data)
+	if fileInfo.Digest != nil && fileInfo.Digest.Size() == req.header.sPos {
+		body = io.TeeReader(body, fileInfo.Digest)
+	} else if fileInfo.Digest != nil && fileInfo.Digest.Size() > req.header.sPos {
+		fileInfo.Digest = nil
+	}
+	iRst, nw = syncf.CheckPosAndCopy(file, req.header.sPos, body, buf)
 	if iRst != syncf.Succeed {
-		log.Println("syncf.CheckPosAndWrte failed reqpos", req.header.sPos, iRst, fileName)
+		log.Println("syncf.CheckPosAndCopy failed reqpos", req.header.sPos, iRst, fileName)
 		fileHandleMap.RemoveFileHandleInfo(fileName)
 		return iRst, nw
 	}
@@ -321,22 +741,83 @@ func handleOperation(conInfo *ConInfo) (int, int){
 	return iRst, 0
 }
 
+// changed blocks of a file already on server, data is checked already. a block
+// is written in place with nothing to undo
+func handlePatch(conInfo *ConInfo, data []byte) (int, int) {
+	req := &conInfo.Req
+	fileName := req.fileName
+	if stat, err := os.Lstat(fileName); err != nil || !stat.Mode().IsRegular() {
+		log.Println("handlePatch not a file", fileName, err)
+		return syncf.FileNotExist, 0
+	}
+
+	iRst, fileInfo := fileHandleMap.GetFileHandleInfo(fileName)
+	if iRst == syncf.FileInfoUsing {
+		return syncf.FileUsing, 0
+	}
+
+	if iRst == syncf.FileInfoNo {
+		file, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+		if err != nil {
+			log.Println("handlePatch OpenFile failed ", fileName, err)
+			return syncf.FileNotExist, 0
+		}
+
+		iRst, nw := syncf.PatchWrite(file, req.header.sPos, req.header.tolSize, data)
+		if iRst != syncf.Succeed {
+			log.Println("syncf.PatchWrite failed reqpos", req.header.sPos, iRst, fileName)
+			file.Close()
+			return iRst, nw
+		}
+		fileHandleMap.AddFileHandleInfo(fileName, file)
+		return iRst, nw
+	}
+
+	fileInfo.Digest = nil
+	iRst, nw := syncf.PatchWrite(fileInfo.File, req.header.sPos, req.header.tolSize, data)
+	if iRst != syncf.Succeed {
+		log.Println("syncf.PatchWrite failed reqpos", req.header.sPos, iRst, fileName)
+		fileHandleMap.RemoveFileHandleInfo(fileName)
+		return iRst, nw
+	}
+	fileHandleMap.PutFileHandleInfo(fileInfo)
+	return iRst, nw
+}
+
 func (header *ReqHeader) Reset() {
+	header.op = 0
+	header.flags = 0
 	header.filePath = ""
 	header.sPos = 0
 	header.size = 0
 	header.tolSize = 0
 	header.comprs = false
+	header.codec = 0
+	header.checksum = 0
+	header.digest = header.digest[:0]
+	header.seq = 0
+	header.stream = 0
+	header.mode = 0
+	header.mtime = 0
+	header.uid = 0
+	header.gid = 0
 }
 
 func (req *Request) Reset() {
 	req.header.Reset()
 	req.data = req.data[0:0]
+	req.body = nil
 }
 
 func BuildRspData(iRst int, iPos int, conInfo *ConInfo) {
-	conInfo.out = append(conInfo.out, syncf.FileOprErr[iRst])
-	conInfo.out = append(conInfo.out, ' ')
-	conInfo.out = append(conInfo.out, []byte(strconv.Itoa(iPos))...)
-	conInfo.out = append(conInfo.out, '\n')
+	rsp := syncf.Frame{Op: syncf.OpResult, Result: iRst, Pos: iPos}
+	if conInfo.Req.header.flags&syncf.FlagSeq != 0 {
+		rsp.Flags |= syncf.FlagSeq
+		rsp.Seq = conInfo.Req.header.seq
+	}
+	if conInfo.Req.header.flags&syncf.FlagStream != 0 {
+		rsp.Flags |= syncf.FlagStream
+		rsp.Stream = conInfo.Req.header.stream
+	}
+	conInfo.out, _ = rsp.Encode(conInfo.out) // no path
 }
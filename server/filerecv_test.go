@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syncfile/syncf"
+	"testing"
+	"time"
+)
+
+// server of a temp dir on a pipe transport, client c1 writes under /c1
+func startTestServer(t *testing.T) (string, *syncf.Connection) {
+	root := t.TempDir()
+	for _, dir := range []string{"c1", "c2"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	svrCfg = SVRCFG{LRPath: root, MaxChunkSize: DefaultMaxChunkSize, MaxStreams: DefaultMaxStreams,
+		StreamWindow: DefaultStreamWindow, Clients: map[string]*ClientAuth{"c1": {Token: "t1", PathPrefix: "/c1"}}}
+	svrHello = syncf.NewHello(svrCfg.MaxChunkSize)
+	svrHello.MaxStreams = svrCfg.MaxStreams
+	svrHello.StreamWindow = svrCfg.StreamWindow
+	svrHello.Features = append(append([]string(nil), svrHello.Features...), syncf.FeatureAuth)
+	if !initPathResolver() {
+		t.Fatal("initPathResolver failed")
+	}
+	fileHandleMap.Map = make(map[string]*syncf.FileHandleInfo)
+
+	tr := syncf.NewPipeTransport()
+	ln, err := tr.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleNewConn(conn, 0)
+		}
+	}()
+
+	local := syncf.NewHello(svrCfg.MaxChunkSize)
+	local.Features = append(append([]string(nil), local.Features...), syncf.FeatureAuth)
+	pool := &syncf.ConnPool{DiaTimout: time.Second, RWTimeout: 5 * time.Second, Hello: &local,
+		Cred: &syncf.Credential{ID: "c1", Token: "t1"}, Transport: tr}
+	cn, err := pool.Get("server")
+	if err != nil {
+		t.Fatal("Get failed", err)
+	}
+	t.Cleanup(func() { cn.Conn.Close() })
+	return root, cn
+}
+
+func sendFrame(t *testing.T, cn *syncf.Connection, f *syncf.Frame) {
+	buf, err := f.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.ExtendDeadline()
+	if _, err = cn.Conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recvFrame(t *testing.T, cn *syncf.Connection) syncf.Frame {
+	var rsp syncf.Frame
+	cn.ExtendDeadline()
+	if _, err := syncf.ReadFrame(cn.Conn, &rsp, nil); err != nil {
+		t.Fatal(err)
+	}
+	return rsp
+}
+
+func writeChunk(pos int, data string, tolSize int, flags uint16) syncf.Frame {
+	return syncf.Frame{Op: syncf.OpWrite, Flags: flags | syncf.FlagChecksum, Pos: pos, TolSize: tolSize,
+		Payload: []byte(data), Checksum: syncf.Checksum([]byte(data))}
+}
+
+func badChecksum(f syncf.Frame) syncf.Frame {
+	f.Checksum ^= 1
+	return f
+}
+
+func withDigest(f syncf.Frame, content string) syncf.Frame {
+	sum := sha256.Sum256([]byte(content))
+	f.Flags |= syncf.FlagDigest
+	f.Digest = sum[:]
+	return f
+}
+
+func TestHandleWrite(t *testing.T) {
+	root, cn := startTestServer(t)
+	if err := os.Symlink("../c2", filepath.Join(root, "c1", "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		name   string
+		path   string // /c1/w<i> if empty
+		old    string // file content before, no file if empty
+		frames []syncf.Frame
+		rsts   []int
+		want   string // file content after, not exist if empty
+	}{
+		{name: "new file",
+			frames: []syncf.Frame{writeChunk(0, "hello ", 11, 0), withDigest(writeChunk(6, "world", 11, 0), "hello world")},
+			rsts:   []int{syncf.Succeed, syncf.Succeed}, want: "hello world"},
+		{name: "crc mismatch on first chunk keeps old file", old: "old content",
+			frames: []syncf.Frame{badChecksum(writeChunk(0, "new", 3, 0))},
+			rsts:   []int{syncf.ChecksumErr}, want: "old content"},
+		{name: "crc mismatch on later chunk not written",
+			frames: []syncf.Frame{writeChunk(0, "abc", 6, 0), badChecksum(writeChunk(3, "def", 6, 0))},
+			rsts:   []int{syncf.Succeed, syncf.ChecksumErr}, want: "abc"},
+		{name: "digest mismatch",
+			frames: []syncf.Frame{writeChunk(0, "abc", 6, 0), withDigest(writeChunk(3, "def", 6, 0), "abcxyz")},
+			rsts:   []int{syncf.Succeed, syncf.DigestErr}, want: "abcdef"},
+		{name: "pos not at end of file",
+			frames: []syncf.Frame{writeChunk(0, "abc", 9, 0), writeChunk(6, "ghi", 9, 0)},
+			rsts:   []int{syncf.Succeed, syncf.FilePosErr}, want: "abc"},
+		{name: "patch in place", old: "0123456789",
+			frames: []syncf.Frame{withDigest(writeChunk(2, "ab", 10, syncf.FlagPatch), "01ab456789")},
+			rsts:   []int{syncf.Succeed}, want: "01ab456789"},
+		{name: "patch crc mismatch", old: "0123456789",
+			frames: []syncf.Frame{badChecksum(writeChunk(2, "ab", 10, syncf.FlagPatch))},
+			rsts:   []int{syncf.ChecksumErr}, want: "0123456789"},
+		{name: "patch of no file",
+			frames: []syncf.Frame{writeChunk(2, "ab", 10, syncf.FlagPatch)},
+			rsts:   []int{syncf.FileNotExist}},
+		{name: "out of prefix", path: "/c2/x",
+			frames: []syncf.Frame{writeChunk(0, "abc", 3, 0)},
+			rsts:   []int{syncf.PathDenied}},
+		{name: "dot dot out of prefix", path: "/c1/../c2/x",
+			frames: []syncf.Frame{writeChunk(0, "abc", 3, 0)},
+			rsts:   []int{syncf.PathDenied}},
+		{name: "link out of prefix", path: "/c1/out/x",
+			frames: []syncf.Frame{writeChunk(0, "abc", 3, 0)},
+			rsts:   []int{syncf.PathInvalid}},
+	} {
+		path := c.path
+		if len(path) == 0 {
+			path = "/c1/w" + strconv.Itoa(i)
+		}
+		fileName := filepath.Join(root, filepath.FromSlash(path))
+		if len(c.old) > 0 {
+			if err := ioutil.WriteFile(fileName, []byte(c.old), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for j := range c.frames {
+			c.frames[j].Path = path
+			sendFrame(t, cn, &c.frames[j])
+			if rsp := recvFrame(t, cn); rsp.Op != syncf.OpResult || rsp.Result != c.rsts[j] {
+				t.Fatal(c.name, "chunk", j, "result", rsp.Op, rsp.Result, "want", c.rsts[j])
+			}
+		}
+
+		data, err := ioutil.ReadFile(fileName)
+		if len(c.want) == 0 {
+			if !os.IsNotExist(err) {
+				t.Fatal(c.name, "file written", fileName, err)
+			}
+			continue
+		}
+		if err != nil || string(data) != c.want {
+			t.Fatal(c.name, "content", string(data), "want", c.want, err)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(root, "c2", "x")); !os.IsNotExist(err) {
+		t.Fatal("written out of prefix", err)
+	}
+}
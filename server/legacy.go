@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"syncfile/syncf"
+)
+
+// clients from before the frame protocol send a text header line for each
+// chunk, "path pos size tolsize compress\n" and size bytes of gzip or plain
+// data, and read "result pos\n". a connection not starting with the frame
+// magic is served this way, as a write without checksum, digest or auth
+
+var (
+	frameStart = []byte{byte(syncf.FrameMagic >> 8), byte(syncf.FrameMagic & 0xff), syncf.FrameVersion}
+)
+
+// true if the first bytes of the connection are not a frame
+func isLegacyConn(conInfo *ConInfo) (bool, error) {
+	head, err := conInfo.rd.Peek(len(frameStart))
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(head, frameStart), nil
+}
+
+// read header line of one chunk, its data is left on connection as req.body.
+// -1 failed, 0 succeed
+func readLegacyReq(conInfo *ConInfo) int {
+	req := &conInfo.Req
+	line, err := conInfo.rd.ReadSlice('\n')
+	if err != nil {
+		log.Println("readLegacyReq", err, conInfo.Conn.RemoteAddr())
+		return -1
+	}
+
+	h := &req.header
+	n, err := fmt.Sscanf(string(line), "%s %d %d %d %t", &h.filePath, &h.sPos, &h.size, &h.tolSize, &h.comprs)
+	if n != 5 || err != nil || h.sPos < 0 || h.size < 0 || h.tolSize < 0 {
+		log.Println("readLegacyReq invalid header", conInfo.Conn.RemoteAddr())
+		return -1
+	}
+	h.op = syncf.OpWrite
+	h.codec = syncf.CodecIDGzip
+	req.body = io.LimitReader(conInfo.rd, int64(h.size))
+	return 0
+}
+
+func buildLegacyRsp(iRst int, iPos int, conInfo *ConInfo) {
+	conInfo.out = append(conInfo.out, strconv.Itoa(iRst)...)
+	conInfo.out = append(conInfo.out, ' ')
+	conInfo.out = append(conInfo.out, strconv.Itoa(iPos)...)
+	conInfo.out = append(conInfo.out, '\n')
+}
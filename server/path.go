@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syncfile/syncf"
+)
+
+// every client path must be under the PathPrefix of an authenticated client and
+// is resolved under the dir of it, links can not lead to the dir of another
+// client. refused paths are written to the audit log, AuditLog file or the
+// server log
+
+var (
+	svrRoot  *syncf.PathResolver
+	auditLog *log.Logger
+
+	opNames = map[uint8]string{
+		syncf.OpWrite: "write", syncf.OpDelete: "delete", syncf.OpRename: "rename", syncf.OpMkdir: "mkdir",
+		syncf.OpRmdir: "rmdir", syncf.OpSetMeta: "setmeta", syncf.OpSymlink: "symlink",
+		syncf.OpSigReq: "sigreq", syncf.OpDelta: "delta",
+	}
+
+	// ops that would remove or replace the whole tree of a client
+	rootDenied = map[string]bool{"delete": true, "rename": true, "rmdir": true}
+)
+
+func initPathResolver() bool {
+	var err error
+	if svrRoot, err = syncf.NewPathResolver(svrCfg.LRPath); err != nil {
+		log.Println("syncf.NewPathResolver failed", svrCfg.LRPath, err)
+		return false
+	}
+	if len(svrCfg.AuditLog) > 0 {
+		file, err := os.OpenFile(svrCfg.AuditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Println("os.OpenFile audit log failed", svrCfg.AuditLog, err)
+			return false
+		}
+		auditLog = log.New(file, "", log.LstdFlags)
+	}
+	for id, cli := range svrCfg.Clients {
+		if cli != nil && len(cli.PathPrefix) > 0 {
+			if _, err = syncf.CleanPath(cli.PathPrefix); err != nil {
+				log.Println("invalid PathPrefix of client", id, cli.PathPrefix)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func auditPath(client string, addr string, op string, path string, reason string) {
+	if auditLog != nil {
+		auditLog.Printf("path refused client=%q addr=%s op=%s path=%q reason=%s", client, addr, op, path, reason)
+		return
+	}
+	log.Printf("audit path refused client=%q addr=%s op=%s path=%q reason=%s", client, addr, op, path, reason)
+}
+
+// local name of client path p, result is PathDenied out of prefix or
+// PathInvalid if it can not be resolved under the dir of prefix
+func resolvePath(client string, addr string, op string, prefix string, p string) (string, int) {
+	if !syncf.InPathPrefix(p, prefix) {
+		auditPath(client, addr, op, p, "out of prefix "+prefix)
+		return "", syncf.PathDenied
+	}
+	root, err := clientRoot(prefix)
+	if err != nil {
+		auditPath(client, addr, op, p, "prefix "+prefix+" "+err.Error())
+		return "", syncf.PathInvalid
+	}
+	var fileName string
+	rel, err := prefixRel(p, prefix)
+	if err == nil {
+		fileName, err = root.Resolve(rel)
+	}
+	if err != nil {
+		auditPath(client, addr, op, p, err.Error())
+		return "", syncf.PathInvalid
+	}
+	if fileName == root.Root && rootDenied[op] {
+		auditPath(client, addr, op, p, "root of client")
+		return "", syncf.PathDenied
+	}
+	return fileName, syncf.Succeed
+}
+
+// resolver of the dir a client is confined to, links in it can not lead out
+func clientRoot(prefix string) (*syncf.PathResolver, error) {
+	if len(prefix) == 0 {
+		return svrRoot, nil
+	}
+	return svrRoot.Sub(prefix)
+}
+
+// p in prefix as a path from the dir of prefix, "/" for the dir itself
+func prefixRel(p string, prefix string) (string, error) {
+	rel, err := syncf.CleanPath(p)
+	if err != nil || len(prefix) == 0 {
+		return "/" + rel, err
+	}
+	pre, err := syncf.CleanPath(prefix)
+	if err != nil {
+		return "", err
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(rel, pre), "/"), nil
+}
+
+func (conInfo *ConInfo) resolvePath(p string) (string, int) {
+	op, ok := opNames[conInfo.Req.header.op]
+	if !ok {
+		op = strconv.Itoa(int(conInfo.Req.header.op))
+	}
+	addr := fmt.Sprint(conInfo.Conn.RemoteAddr()) // nil of unix socket
+	return resolvePath(conInfo.clientID, addr, op, conInfo.pathPrefix, p)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syncfile/syncf"
+)
+
+// ingress limit of each client, ClientRateLimit or RateLimit of the client in
+// Clients. all connections of a client share one limiter, a client is its id
+// after auth or its remote host before
+
+var (
+	clientLimitLock sync.Mutex
+	clientLimits    = make(map[string]*syncf.RateLimiter)
+)
+
+func clientLimiter(key string, rate int) *syncf.RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	clientLimitLock.Lock()
+	defer clientLimitLock.Unlock()
+	l, ok := clientLimits[key]
+	if !ok {
+		l = syncf.NewRateLimiter(rate, 0)
+		clientLimits[key] = l
+	}
+	return l
+}
+
+func hostLimiter(conn net.Conn) *syncf.RateLimiter {
+	addr := fmt.Sprint(conn.RemoteAddr())
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return clientLimiter("host "+addr, svrCfg.ClientRateLimit)
+}
+
+func idLimiter(id string, cli *ClientAuth) *syncf.RateLimiter {
+	rate := cli.RateLimit
+	if rate == 0 {
+		rate = svrCfg.ClientRateLimit
+	}
+	return clientLimiter("client "+id, rate)
+}
+
+// reads of the connection wait for the limiter of the client
+type rateReader struct {
+	conInfo *ConInfo
+}
+
+func (r rateReader) Read(p []byte) (int, error) {
+	n, err := r.conInfo.Conn.Read(p)
+	if n > 0 {
+		r.conInfo.limiter.Wait(n)
+	}
+	return n, err
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"crypto/tls"
 	"github.com/panjf2000/ants/v2"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strconv"
 	"syncfile/syncf"
 	"time"
 )
 
 const (
 	ReadWriteDeadLine = 15
+	ReadBufSize = 32*1024
+	CopyBufSize = 64*1024
+	DefaultMaxChunkSize = 4*1024*1024
+	DefaultMaxStreams = 256
+	DefaultStreamWindow = 16
 )
 
 const (
@@ -25,6 +32,8 @@ var (
 	grPool *ants.Pool
 
 	svrCfg SVRCFG
+	svrHello syncf.Hello
+	svrTLS *tls.Config // nil without tls
 
 	grPoolSize = 10000
 	FileHandleTimeout = 120
@@ -37,6 +46,32 @@ type SVRCFG struct {
 	DebugAddr         string `json:"DebugAddr"`
 	GrPoolSize        int    `json:"GoRoutinePoolSize"`
 	FileHandleTimeout int    `json:"FileHandleTimeout"`
+	MaxChunkSize      int    `json:"MaxChunkSize"`
+	MaxStreams        int    `json:"MaxStreams"`   // streams on one client connection
+	StreamWindow      int    `json:"StreamWindow"` // chunks in flight of one stream
+	UidMap            map[string]int `json:"UidMap"` // client uid to server uid
+	GidMap            map[string]int `json:"GidMap"` // client gid to server gid
+	TLSCert           string `json:"TLSCert"` // tls on upload and api addr if set
+	TLSKey            string `json:"TLSKey"`
+	TLSCA             string `json:"TLSCA"`         // ca of client certs
+	TLSClientAuth     bool   `json:"TLSClientAuth"` // require client cert signed by TLSCA
+	Clients           map[string]*ClientAuth `json:"Clients"` // client id to credential, auth required if set
+	ClientRateLimit   int    `json:"ClientRateLimit"` // bytes/s from each client, 0 no limit
+	AuditLog          string `json:"AuditLog"` // file of refused paths, server log if not set
+	UnixAddr          string `json:"UnixAddr"` // also listen on this unix socket if set
+	KCPAddr           string `json:"KCPAddr"` // also listen kcp on this udp addr if set
+	KCP               *syncf.KCPConfig `json:"KCP"` // fec shards same as clients
+}
+
+// ids not in map are kept
+func (cfg *SVRCFG) MapOwner(uid int, gid int) (int, int) {
+	if v, ok := cfg.UidMap[strconv.Itoa(uid)]; ok {
+		uid = v
+	}
+	if v, ok := cfg.GidMap[strconv.Itoa(gid)]; ok {
+		gid = v
+	}
+	return uid, gid
 }
 
 func main() {
@@ -45,7 +80,8 @@ func main() {
 	}
 
 	go func() {
-		log.Println(http.ListenAndServe(svrCfg.DebugAddr, nil))
+		// only pprof is on the default mux, the api is served by WebAPILoop
+		log.Println(http.ListenAndServe(svrCfg.DebugAddr, http.DefaultServeMux))
 	}()
 
 	go WebAPILoop()
@@ -60,27 +96,45 @@ func main() {
 	}
 	defer grPool.Release()
 
-	if listener, err := net.Listen("tcp", svrCfg.SvrUploadAddr); err == nil {
-		// spin-up the client
-		log.Println("Server started ", listener.Addr().String())
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			log.Println("New connection ", conn.RemoteAddr())
-			err = putHandlePool(conn)
-			if err != nil {
-				log.Println("Close connection ", conn.RemoteAddr(), err)
-				conn.Close()
-				time.Sleep(time.Second*2)
-			}
-		}
-	} else {
+	// same handling on each transport
+	if len(svrCfg.UnixAddr) > 0 {
+		go acceptLoop(listen(syncf.UnixTransport{}, svrCfg.UnixAddr), 0)
+	}
+	if len(svrCfg.KCPAddr) > 0 {
+		go acceptLoop(listen(syncf.KCPTransport{Config: svrCfg.KCP}, svrCfg.KCPAddr), svrCfg.KCP.Idle())
+	}
+	acceptLoop(listen(syncf.TCPTransport{}, svrCfg.SvrUploadAddr), 0)
+}
+
+func listen(tr syncf.Transport, addr string) net.Listener {
+	listener, err := tr.Listen(addr)
+	if err != nil {
 		log.Fatal(err)
 	}
+	return listener
+}
 
+// idle is the read timeout of a connection, 0 for none
+func acceptLoop(listener net.Listener, idle time.Duration) {
+	if svrTLS != nil {
+		listener = tls.NewListener(listener, svrTLS)
+	}
+	// spin-up the client
+	log.Println("Server started ", listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("New connection ", conn.RemoteAddr())
+		err = putHandlePool(conn, idle)
+		if err != nil {
+			log.Println("Close connection ", conn.RemoteAddr(), err)
+			conn.Close()
+			time.Sleep(time.Second*2)
+		}
+	}
 }
 
 func loadCfg(cname string) bool {
@@ -98,11 +152,38 @@ func loadCfg(cname string) bool {
 		grPoolSize = svrCfg.GrPoolSize
 	}
 
+	if svrCfg.MaxChunkSize == 0 {
+		svrCfg.MaxChunkSize = DefaultMaxChunkSize
+	}
+	if svrCfg.MaxStreams <= 0 {
+		svrCfg.MaxStreams = DefaultMaxStreams
+	}
+	if svrCfg.StreamWindow <= 0 {
+		svrCfg.StreamWindow = DefaultStreamWindow
+	}
+	if len(svrCfg.TLSCert) > 0 {
+		var err error
+		svrTLS, err = syncf.ServerTLS(svrCfg.TLSCert, svrCfg.TLSKey, svrCfg.TLSCA, svrCfg.TLSClientAuth)
+		if err != nil {
+			log.Println("syncf.ServerTLS failed", err)
+			return false
+		}
+	}
+	svrHello = syncf.NewHello(svrCfg.MaxChunkSize)
+	svrHello.MaxStreams = svrCfg.MaxStreams
+	svrHello.StreamWindow = svrCfg.StreamWindow
+	if authRequired() {
+		svrHello.Features = append(append([]string(nil), svrHello.Features...), syncf.FeatureAuth)
+	}
+
 	err := os.MkdirAll(svrCfg.LRPath, os.ModePerm)
 	if err != nil {
 		log.Println("os.MkdirAll failed", svrCfg.LRPath, err)
 		return false
 	}
+	if !initPathResolver() {
+		return false
+	}
 
 	return true
 }
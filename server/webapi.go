@@ -8,9 +8,17 @@ import (
 	"syncfile/syncf"
 )
 
+// api has its own mux, pprof of DebugAddr is on http.DefaultServeMux and must
+// not serve the api without tls and auth
 func WebAPILoop() {
-	http.HandleFunc("/api/getpathfile", GetFiles)
-	log.Fatal(http.ListenAndServe(svrCfg.SvrApiAddr, nil))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/getpathfile", GetFiles)
+	svr := &http.Server{Addr: svrCfg.SvrApiAddr, Handler: mux}
+	if svrTLS != nil {
+		svr.TLSConfig = svrTLS
+		log.Fatal(svr.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(svr.ListenAndServe())
 }
 
 func GetFiles(w http.ResponseWriter, r *http.Request) {
@@ -20,19 +28,37 @@ func GetFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var prefix string
+	if authRequired() {
+		cli, ok := checkAPIAuth(r, body)
+		if !ok {
+			log.Println("GetFiles auth failed", r.Header.Get(syncf.HeaderClientID), r.RemoteAddr)
+			http.Error(w, "auth failed", http.StatusUnauthorized)
+			return
+		}
+		prefix = cli.PathPrefix
+	}
+
 	var req syncf.PathFileReq
 	if err = json.Unmarshal(body, &req); err != nil {
 		log.Println("Unmarshal err ", err)
 		return
 	}
-
 	var rsp syncf.PathFileRsq
 	var pathFiles syncf.PathFiles
-	var path string
+	client := r.Header.Get(syncf.HeaderClientID)
 	for _, val := range req.RPaths {
-		path = svrCfg.LRPath+val
+		path, iRst := resolvePath(client, r.RemoteAddr, "getpathfile", prefix, val)
+		if iRst != syncf.Succeed {
+			http.Error(w, "path not allowed", http.StatusForbidden)
+			return
+		}
 		pathFiles.Path= path
-		pathFiles.Files = syncf.GetPathFileStat(path)
+		if req.Recursive {
+			pathFiles.Files = syncf.GetTreeFileStat(path)
+		} else {
+			pathFiles.Files = syncf.GetPathFileStat(path)
+		}
 		pathFiles.Path= val  // reset to req path
 		rsp.Pathfiles = append(rsp.Pathfiles, pathFiles)
 	}
@@ -47,4 +73,16 @@ func GetFiles(w http.ResponseWriter, r *http.Request) {
 
 	_,_ =w.Write(data)
 
-}
\ No newline at end of file
+}
+// signed by secret or with token of the client
+func checkAPIAuth(r *http.Request, body []byte) (*ClientAuth, bool) {
+	cli, ok := svrCfg.Clients[r.Header.Get(syncf.HeaderClientID)]
+	if !ok || cli == nil {
+		return nil, false
+	}
+	if sign := r.Header.Get(syncf.HeaderAuthSign); len(sign) > 0 {
+		ts := r.Header.Get(syncf.HeaderAuthTime)
+		return cli, syncf.CheckAuthTime(ts) && syncf.CheckHMAC(cli.Secret, sign, []byte(ts), body)
+	}
+	return cli, syncf.CheckToken(cli.Token, r.Header.Get(syncf.HeaderAuthToken))
+}
@@ -0,0 +1,146 @@
+package syncf
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client authentication. a server requiring auth has FeatureAuth and sends a
+// challenge in hello ack, the client answers with OpAuth before other requests:
+//
+//	token  the pre-shared token as is, use with tls
+//	hmac   hex hmac-sha256 of the challenge with the pre-shared secret
+//
+// web api requests carry the client id, a unix time and the hmac of time and body
+
+const (
+	AuthMethodToken = "token"
+	AuthMethodHMAC  = "hmac"
+	ChallengeSize   = 32
+	AuthMaxSkew     = 5 * time.Minute
+
+	HeaderClientID  = "X-Sync-Client"
+	HeaderAuthTime  = "X-Sync-Time"
+	HeaderAuthToken = "X-Sync-Token"
+	HeaderAuthSign  = "X-Sync-Sign"
+)
+
+var (
+	ErrAuthFailed = errors.New("auth failed")
+)
+
+// credential of a client, Secret is used if both set
+type Credential struct {
+	ID     string
+	Token  string
+	Secret string
+}
+
+// payload of OpAuth
+type Auth struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	Proof  string `json:"proof"`
+}
+
+func NewChallenge() (string, error) {
+	buf := make([]byte, ChallengeSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func HMACSign(secret string, data ...[]byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, v := range data {
+		mac.Write(v)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func CheckHMAC(secret string, sign string, data ...[]byte) bool {
+	return len(secret) > 0 && hmac.Equal([]byte(HMACSign(secret, data...)), []byte(sign))
+}
+
+func CheckToken(token string, proof string) bool {
+	return len(token) > 0 && hmac.Equal([]byte(token), []byte(proof))
+}
+
+func (c *Credential) answer(challenge string) Auth {
+	if len(c.Secret) > 0 {
+		return Auth{ID: c.ID, Method: AuthMethodHMAC, Proof: HMACSign(c.Secret, []byte(challenge))}
+	}
+	return Auth{ID: c.ID, Method: AuthMethodToken, Proof: c.Token}
+}
+
+func DecodeAuth(data []byte) (Auth, error) {
+	var auth Auth
+	err := json.Unmarshal(data, &auth)
+	return auth, err
+}
+
+// answer the challenge of hello ack
+func (cn *Connection) Authenticate(c *Credential) error {
+	data, _ := json.Marshal(c.answer(cn.challenge))
+	req := Frame{Op: OpAuth, Path: c.ID, Payload: data}
+	buf, err := req.Encode(nil)
+	if err != nil {
+		return err
+	}
+	cn.ExtendDeadline()
+	if _, err = cn.Conn.Write(buf); err != nil {
+		return err
+	}
+
+	var rsp Frame
+	cn.ExtendDeadline()
+	if _, err := ReadFrame(cn.Conn, &rsp, nil); err != nil {
+		return err
+	}
+	if rsp.Op != OpResult || rsp.Result != Succeed {
+		return ErrAuthFailed
+	}
+	cn.RateLimit = rsp.Pos
+	return nil
+}
+
+// headers of a web api request with body
+func (c *Credential) SignHeader(body []byte) map[string]string {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	header := map[string]string{HeaderClientID: c.ID, HeaderAuthTime: ts}
+	if len(c.Secret) > 0 {
+		header[HeaderAuthSign] = HMACSign(c.Secret, []byte(ts), body)
+	} else {
+		header[HeaderAuthToken] = c.Token
+	}
+	return header
+}
+
+// time of a signed web api request not too far from now
+func CheckAuthTime(ts string) bool {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	d := time.Since(time.Unix(sec, 0))
+	return d < AuthMaxSkew && d > -AuthMaxSkew
+}
+
+// p is prefix or under it, after cleaning. empty prefix allows all
+func InPathPrefix(p string, prefix string) bool {
+	if len(prefix) == 0 {
+		return true
+	}
+	p = path.Clean("/" + p)
+	prefix = path.Clean("/" + prefix)
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
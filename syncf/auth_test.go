@@ -0,0 +1,109 @@
+package syncf
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInPathPrefix(t *testing.T) {
+	for _, c := range []struct {
+		path   string
+		prefix string
+		ok     bool
+	}{
+		{"/mac/a.txt", "/mac", true},
+		{"/mac", "/mac/", true},
+		{"mac/dir/a", "/mac", true},
+		{"/mac2/a.txt", "/mac", false},
+		{"/mac/../other/a.txt", "/mac", false},
+		{"/other/a.txt", "", true},
+		{"/other/a.txt", "/", true},
+	} {
+		if InPathPrefix(c.path, c.prefix) != c.ok {
+			t.Fatal("InPathPrefix wrong", c.path, c.prefix)
+		}
+	}
+}
+
+// hello ack with challenge, OpAuth checked with secret
+func serveAuth(ln net.Listener, secret string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	challenge, _ := NewChallenge()
+	var f Frame
+	var buf []byte
+	for {
+		if buf, err = ReadFrame(conn, &f, buf); err != nil {
+			return
+		}
+		var rsp Frame
+		switch f.Op {
+		case OpHello:
+			ack := NewHello(1024)
+			ack.Features = append(ack.Features, FeatureAuth)
+			ack.Challenge = challenge
+			rsp = Frame{Op: OpHelloAck, Payload: ack.Encode()}
+		case OpAuth:
+			rsp = Frame{Op: OpResult, Result: AuthFailed}
+			if auth, err := DecodeAuth(f.Payload); err == nil && auth.Method == AuthMethodHMAC &&
+				CheckHMAC(secret, auth.Proof, []byte(challenge)) {
+				rsp.Result = Succeed
+			}
+		}
+		buf, _ := rsp.Encode(nil)
+		if _, err = conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for i := 0; i < 3; i++ {
+			serveAuth(ln, "secret")
+		}
+	}()
+
+	get := func(cred *Credential) error {
+		local := NewHello(1024)
+		local.Features = append(local.Features, FeatureAuth)
+		pool := &ConnPool{DiaTimout: time.Second, RWTimeout: 5 * time.Second, Hello: &local, Cred: cred}
+		cn, err := pool.Get(ln.Addr().String())
+		if err == nil {
+			cn.Conn.Close()
+		}
+		return err
+	}
+	if err = get(&Credential{ID: "c1", Secret: "secret"}); err != nil {
+		t.Fatal("auth failed", err)
+	}
+	if err = get(&Credential{ID: "c1", Secret: "wrong"}); err != ErrAuthFailed {
+		t.Fatal("wrong secret accepted", err)
+	}
+	if err = get(nil); err == nil {
+		t.Fatal("no credential accepted")
+	}
+}
+
+func TestAuthSign(t *testing.T) {
+	cred := Credential{ID: "c1", Secret: "secret"}
+	header := cred.SignHeader([]byte("body"))
+	if !CheckAuthTime(header[HeaderAuthTime]) ||
+		!CheckHMAC("secret", header[HeaderAuthSign], []byte(header[HeaderAuthTime]), []byte("body")) ||
+		CheckHMAC("secret", header[HeaderAuthSign], []byte(header[HeaderAuthTime]), []byte("other")) {
+		t.Fatal("signed header check failed", header)
+	}
+	if CheckAuthTime("1") || !CheckToken("tk", "tk") || CheckToken("", "") {
+		t.Fatal("auth time or token check failed")
+	}
+}
@@ -0,0 +1,305 @@
+package syncf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// compression codecs of chunk payload. the id is sent in the frame with
+// FlagCodec, FlagCompress without FlagCodec is gzip. the names are
+// negotiated in hello. level 0 is the default level of the codec.
+// compressed data is read as a stream, a chunk is never held whole on server
+
+const (
+	CodecNone   = "none"
+	CodecZstd   = "zstd"
+	CodecLz4    = "lz4"
+	CodecSnappy = "snappy"
+)
+
+const (
+	CodecIDGzip uint8 = iota + 1
+	CodecIDZstd
+	CodecIDLz4
+	CodecIDSnappy
+)
+
+const (
+	zstdMaxWindow   = 8 * 1024 * 1024
+	snappyBlockSize = 64 * 1024
+)
+
+var (
+	ErrDecompressed = errors.New("decompressed data too long")
+)
+
+type Codec interface {
+	Name() string
+	ID() uint8
+	// append compressed src to dst
+	Compress(dst []byte, src []byte, level int) ([]byte, error)
+	// decompress the data read from r, Close to release the reader
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecLock   sync.RWMutex
+	codecByName = make(map[string]Codec)
+	codecByID   = make(map[uint8]Codec)
+)
+
+func init() {
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(&zstdCodec{encoders: make(map[int]*zstd.Encoder)})
+	RegisterCodec(lz4Codec{})
+	RegisterCodec(snappyCodec{})
+}
+
+// add a codec, replace the one with same name or id
+func RegisterCodec(c Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecByName[c.Name()] = c
+	codecByID[c.ID()] = c
+}
+
+func GetCodec(name string) Codec {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	return codecByName[name]
+}
+
+func GetCodecByID(id uint8) Codec {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	return codecByID[id]
+}
+
+// codec of a frame with FlagCompress
+func FrameCodec(f *Frame) Codec {
+	if f.Flags&FlagCodec == 0 {
+		return GetCodecByID(CodecIDGzip)
+	}
+	return GetCodecByID(f.Codec)
+}
+
+// set payload of f to data compressed by c, dst is used for the payload if large enough
+func CompressFrame(f *Frame, c Codec, level int, data []byte, dst []byte) error {
+	out, err := c.Compress(dst[:0], data, level)
+	if err != nil {
+		return err
+	}
+	f.Payload = out
+	f.Flags |= FlagCompress
+	if c.ID() != CodecIDGzip {
+		f.Flags |= FlagCodec
+		f.Codec = c.ID()
+	}
+	return nil
+}
+
+// decompress src at once, fail if longer than max
+func Decompress(c Codec, src []byte, max int) ([]byte, error) {
+	r, err := c.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(LimitReader(r, max))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// reader fails with ErrDecompressed after max bytes
+func LimitReader(r io.Reader, max int) io.Reader {
+	return &limitReader{r: r, left: int64(max)}
+}
+
+type limitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		var one [1]byte
+		n, err := l.r.Read(one[:])
+		if n > 0 {
+			return 0, ErrDecompressed
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// writer appending to a slice
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return CodecGzip }
+func (gzipCodec) ID() uint8    { return CodecIDGzip }
+
+func (gzipCodec) Compress(dst []byte, src []byte, level int) ([]byte, error) {
+	out := &appendWriter{buf: dst}
+	var w *gzip.Writer
+	if level == 0 {
+		w = gzipWriterPool.Get().(*gzip.Writer)
+		w.Reset(out)
+		defer gzipWriterPool.Put(w)
+	} else {
+		var err error
+		if w, err = gzip.NewWriterLevel(out, level); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.buf, nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// encoders are safe for concurrent EncodeAll, one for each level used.
+// decoders are pooled, each one keeps its window
+type zstdCodec struct {
+	sync.Mutex
+	encoders map[int]*zstd.Encoder
+	decoders sync.Pool
+}
+
+func (*zstdCodec) Name() string { return CodecZstd }
+func (*zstdCodec) ID() uint8    { return CodecIDZstd }
+
+func (c *zstdCodec) encoder(level int) (*zstd.Encoder, error) {
+	c.Lock()
+	defer c.Unlock()
+	if enc, ok := c.encoders[level]; ok {
+		return enc, nil
+	}
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.encoders[level] = enc
+	return enc, nil
+}
+
+func (c *zstdCodec) Compress(dst []byte, src []byte, level int) ([]byte, error) {
+	enc, err := c.encoder(level)
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(src, dst), nil
+}
+
+type zstdReader struct {
+	*zstd.Decoder
+	c *zstdCodec
+}
+
+func (r zstdReader) Close() error {
+	_ = r.Decoder.Reset(nil)
+	r.c.decoders.Put(r.Decoder)
+	return nil
+}
+
+func (c *zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if dec, ok := c.decoders.Get().(*zstd.Decoder); ok {
+		if err := dec.Reset(r); err != nil {
+			return nil, err
+		}
+		return zstdReader{Decoder: dec, c: c}, nil
+	}
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+		zstd.WithDecoderMaxWindow(zstdMaxWindow))
+	if err != nil {
+		return nil, err
+	}
+	return zstdReader{Decoder: dec, c: c}, nil
+}
+
+// lz4 frame format
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string { return CodecLz4 }
+func (lz4Codec) ID() uint8    { return CodecIDLz4 }
+
+// level 1 to 9 as lz4 -1 to -9, 0 is fast
+func (lz4Codec) Compress(dst []byte, src []byte, level int) ([]byte, error) {
+	out := &appendWriter{buf: dst}
+	w := lz4.NewWriter(out)
+	if level > 9 {
+		level = 9
+	}
+	if level > 0 {
+		if err := w.Apply(lz4.CompressionLevelOption(lz4.CompressionLevel(1 << (8 + level)))); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.buf, nil
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(lz4.NewReader(r)), nil
+}
+
+// snappy framing format, level is ignored
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return CodecSnappy }
+func (snappyCodec) ID() uint8    { return CodecIDSnappy }
+
+func (snappyCodec) Compress(dst []byte, src []byte, level int) ([]byte, error) {
+	out := &appendWriter{buf: dst}
+	w := s2.NewWriter(out, s2.WriterSnappyCompat(), s2.WriterConcurrency(1), s2.WriterBlockSize(snappyBlockSize))
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.buf, nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(s2.NewReader(r, s2.ReaderMaxBlockSize(snappyBlockSize))), nil
+}
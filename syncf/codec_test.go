@@ -0,0 +1,85 @@
+package syncf
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	data := bytes.Repeat([]byte("some text to compress, "), 5000)
+	noise := make([]byte, 10000)
+	rnd.Read(noise)
+	data = append(data, noise...)
+
+	for _, name := range SupportCodecs {
+		c := GetCodec(name)
+		if c == nil || GetCodecByID(c.ID()) != c {
+			t.Fatal("codec not registered", name)
+		}
+		for _, level := range []int{0, 1, 9} {
+			f := Frame{Op: OpWrite}
+			if err := CompressFrame(&f, c, level, data, nil); err != nil {
+				t.Fatal("CompressFrame failed", name, level, err)
+			}
+			if len(f.Payload) >= len(data) {
+				t.Fatal("data not compressed", name, level, len(f.Payload))
+			}
+
+			var dst Frame
+			buf, _ := f.Encode(nil)
+			if _, err := DecodeFrame(buf, &dst); err != nil {
+				t.Fatal("DecodeFrame failed", name, err)
+			}
+			out, err := Decompress(FrameCodec(&dst), dst.Payload, len(data))
+			if err != nil || !bytes.Equal(out, data) {
+				t.Fatal("data not equal", name, level, err)
+			}
+			if _, err = Decompress(c, f.Payload, len(data)-1); err != ErrDecompressed {
+				t.Fatal("decompressed length not limited", name, level)
+			}
+		}
+	}
+}
+
+func TestCodecGzipLegacy(t *testing.T) {
+	f := Frame{Op: OpWrite, Flags: FlagCompress, Payload: GzipCompress([]byte("legacy gzip payload"))}
+	if c := FrameCodec(&f); c == nil || c.Name() != CodecGzip {
+		t.Fatal("frame without codec id is not gzip")
+	}
+	if err := CompressFrame(&f, GetCodec(CodecGzip), 0, []byte("gzip"), nil); err != nil || f.Flags&FlagCodec != 0 {
+		t.Fatal("gzip frame has codec id", f.Flags, err)
+	}
+}
+
+func TestCodecStream(t *testing.T) {
+	data := bytes.Repeat([]byte("stream through a small buffer "), 100000)
+	for _, name := range SupportCodecs {
+		c := GetCodec(name)
+		dst := make([]byte, 0, 1024)
+		payload, err := c.Compress(dst[:0], data, 0)
+		if err != nil {
+			t.Fatal("Compress failed", name, err)
+		}
+		for i := 0; i < 2; i++ { // reader from pool
+			r, err := c.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal("NewReader failed", name, err)
+			}
+			var out bytes.Buffer
+			buf := make([]byte, 4096)
+			for {
+				n, err := r.Read(buf)
+				out.Write(buf[:n])
+				if err != nil {
+					break
+				}
+			}
+			_ = r.Close()
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatal("stream data not equal", name, out.Len())
+			}
+		}
+	}
+}
@@ -1,27 +1,37 @@
 package syncf
 
 import (
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"sync"
 	"time"
 )
 
-// multi addr connection pool
-// TODO only support net.Conn now, can support more kind of Conn interface
+// multi addr connection pool, connections are made by Transport
 type Connection struct {
 	Conn   net.Conn
 	Addr string
 	cpool *ConnPool
 	time time.Time
+	Caps  Hello // negotiated with server
+	challenge string // of server requires auth
+	RateLimit int // bytes/s the server reads from the client, 0 no limit
+	ingress *RateLimiter // mirror of RateLimit, shared by connections to addr
 }
 
 type ConnPool struct {
 	DiaTimout time.Duration
 	RWTimeout time.Duration
 	MaxIdleConns int
+	Hello    *Hello // handshake on new connection if not nil
+	TLS      *tls.Config // tls on new connection if not nil
+	Cred     *Credential // answer server requires auth
+	Transport Transport  // tcp if nil
 	lk       sync.Mutex
 	freeconn map[string][]*Connection
+	ingress  map[string]*RateLimiter
 }
 
 func (cn *Connection) ExtendDeadline() {
@@ -78,20 +88,71 @@ func (c *ConnPool) Get(addr string) (*Connection, error) {
 		Addr:  addr,
 		cpool:    c,
 		time: time.Now(),
+		Caps: LegacyHello,
 	}
 	cn.ExtendDeadline()
+	if c.Hello != nil {
+		if err = cn.Handshake(*c.Hello); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if cn.Caps.HasFeature(FeatureAuth) {
+			if c.Cred == nil {
+				err = errors.New("server requires auth, no credential")
+			} else {
+				err = cn.Authenticate(c.Cred)
+			}
+			if err != nil {
+				nc.Close()
+				return nil, err
+			}
+		}
+	}
+	cn.ingress = c.ingressLimiter(addr, cn.RateLimit)
 	return cn, nil
 }
 
+// the server limits a client on all its connections, so is the mirror of the
+// limit shared by the connections to addr. nil if no limit
+func (c *ConnPool) ingressLimiter(addr string, rate int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.ingress == nil {
+		c.ingress = make(map[string]*RateLimiter)
+	}
+	l := c.ingress[addr]
+	if l.Rate() != rate {
+		l = NewRateLimiter(rate, 0)
+		c.ingress[addr] = l
+	}
+	return l
+}
+
 func (c *ConnPool) dial(addr string) (net.Conn, error) {
 	type connError struct {
 		cn  net.Conn
 		err error
 	}
 
-	nc, err := net.DialTimeout("tcp", addr, c.DiaTimout)
+	tr := c.Transport
+	if tr == nil {
+		tr = TCPTransport{}
+	}
+	nc, err := tr.Dial(addr, c.DiaTimout)
 	if err == nil {
-		return nc, nil
+		if c.TLS == nil {
+			return nc, nil
+		}
+		_ = nc.SetDeadline(time.Now().Add(c.DiaTimout))
+		tc, err := clientTLSConn(nc, c.TLS, addr)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		return tc, nil
 	}
 
 	if ne, ok := err.(net.Error); ok && ne.Timeout() {
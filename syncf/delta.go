@@ -0,0 +1,382 @@
+package syncf
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// rsync style delta. the server sends signatures of the blocks of its copy,
+// the client sends the new file as copies of those blocks and literal data.
+//
+// signature: blocksize(4) size(8) | weak(4) strong(16) per block
+// delta ops:
+//
+//	'C' index(4) count(4)  copy count blocks of the old file from index
+//	'L' len(4) data        literal data
+
+const (
+	StrongSize   = 16
+	MinBlockSize = 1024
+	MaxBlockSize = 128 * 1024
+
+	sigHeadLen  = 12
+	blockSigLen = 4 + StrongSize
+
+	deltaCopy       = 'C'
+	deltaLiteral    = 'L'
+	deltaCopyLen    = 9
+	deltaLiteralLen = 5
+)
+
+var (
+	ErrSignature = errors.New("invalid signature")
+	ErrDelta     = errors.New("invalid delta")
+)
+
+type BlockSig struct {
+	Weak   uint32
+	Strong [StrongSize]byte
+}
+
+type Signature struct {
+	BlockSize int
+	Size      int // size of the old file, the last block may be short
+	Blocks    []BlockSig
+}
+
+// about the square root of size, in KB
+func DeltaBlockSize(size int) int {
+	bs := int(math.Sqrt(float64(size))) &^ 1023
+	if bs < MinBlockSize {
+		return MinBlockSize
+	}
+	if bs > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return bs
+}
+
+// rolling checksum of rsync
+func WeakSum(block []byte) uint32 {
+	var a, b uint32
+	l := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// move the window of l bytes one byte forward
+func rollSum(sum uint32, l int, out, in byte) uint32 {
+	a := (sum - uint32(out) + uint32(in)) & 0xffff
+	b := ((sum >> 16) - uint32(l)*uint32(out) + a) & 0xffff
+	return a | b<<16
+}
+
+func strongSum(block []byte) (s [StrongSize]byte) {
+	sum := sha256.Sum256(block)
+	copy(s[:], sum[:])
+	return s
+}
+
+// signature of the first size bytes of r
+func MakeSignature(r io.Reader, size int, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, ErrSignature
+	}
+	sig := &Signature{BlockSize: blockSize, Size: size}
+	buf := make([]byte, blockSize)
+	for off := 0; off < size; off += blockSize {
+		l := blockSize
+		if l > size-off {
+			l = size - off
+		}
+		if _, err := io.ReadFull(r, buf[:l]); err != nil {
+			return nil, err
+		}
+		sig.Blocks = append(sig.Blocks, BlockSig{Weak: WeakSum(buf[:l]), Strong: strongSum(buf[:l])})
+	}
+	return sig, nil
+}
+
+func (sig *Signature) Encode() []byte {
+	buf := make([]byte, sigHeadLen, sigHeadLen+len(sig.Blocks)*blockSigLen)
+	binary.BigEndian.PutUint32(buf[0:], uint32(sig.BlockSize))
+	binary.BigEndian.PutUint64(buf[4:], uint64(sig.Size))
+	var b [blockSigLen]byte
+	for _, v := range sig.Blocks {
+		binary.BigEndian.PutUint32(b[0:], v.Weak)
+		copy(b[4:], v.Strong[:])
+		buf = append(buf, b[:]...)
+	}
+	return buf
+}
+
+func DecodeSignature(data []byte) (*Signature, error) {
+	if len(data) < sigHeadLen {
+		return nil, ErrSignature
+	}
+	sig := &Signature{BlockSize: int(binary.BigEndian.Uint32(data[0:])), Size: int(binary.BigEndian.Uint64(data[4:]))}
+	if sig.BlockSize <= 0 || sig.Size < 0 {
+		return nil, ErrSignature
+	}
+	count := (sig.Size + sig.BlockSize - 1) / sig.BlockSize
+	data = data[sigHeadLen:]
+	if len(data) != count*blockSigLen {
+		return nil, ErrSignature
+	}
+	sig.Blocks = make([]BlockSig, count)
+	for i := range sig.Blocks {
+		sig.Blocks[i].Weak = binary.BigEndian.Uint32(data[0:])
+		copy(sig.Blocks[i].Strong[:], data[4:blockSigLen])
+		data = data[blockSigLen:]
+	}
+	return sig, nil
+}
+
+func (sig *Signature) blockLen(idx int) int {
+	if l := sig.Size - idx*sig.BlockSize; l < sig.BlockSize {
+		return l
+	}
+	return sig.BlockSize
+}
+
+type deltaGen struct {
+	sig      *Signature
+	table    map[uint32][]int // weak sum to index of full blocks
+	maxBatch int
+	emit     func(ops []byte, n int) error
+	ops      []byte
+	n        int // new data length of ops
+	lastCopy int // offset of the last copy op in ops, -1 if none
+	emitted  bool
+	literal  int
+}
+
+// ops of the new data in r against sig, given to emit in batches not larger than maxBatch
+// with the length of new data they make. emit is called at least once, ops is only valid
+// during the call. returns the literal data length
+func GenDelta(sig *Signature, r io.Reader, maxBatch int, emit func(ops []byte, n int) error) (int, error) {
+	if maxBatch < 64 {
+		maxBatch = 64
+	}
+	g := &deltaGen{sig: sig, table: make(map[uint32][]int), maxBatch: maxBatch, emit: emit, lastCopy: -1}
+	bs := sig.BlockSize
+	for i := 0; i < sig.Size/bs; i++ {
+		g.table[sig.Blocks[i].Weak] = append(g.table[sig.Blocks[i].Weak], i)
+	}
+
+	maxLiteral := maxBatch - deltaLiteralLen
+	buf := make([]byte, 0, maxLiteral+2*bs+64*1024)
+	start, lit := 0, 0 // window and literal start in buf
+	eof := false
+	fresh := true
+	var sum uint32
+	for {
+		// a window and the byte after it
+		for !eof && len(buf)-start <= bs {
+			if cap(buf)-len(buf) < bs && lit > 0 {
+				n := copy(buf, buf[lit:])
+				buf = buf[:n]
+				start -= lit
+				lit = 0
+			}
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return g.literal, err
+			}
+		}
+		if len(buf)-start < bs {
+			break
+		}
+
+		if fresh {
+			sum = WeakSum(buf[start : start+bs])
+			fresh = false
+		}
+		if idx := g.match(sum, buf[start:start+bs]); idx >= 0 {
+			if err := g.addLiteral(buf[lit:start]); err != nil {
+				return g.literal, err
+			}
+			if err := g.addCopy(idx); err != nil {
+				return g.literal, err
+			}
+			start += bs
+			lit = start
+			fresh = true
+			continue
+		}
+
+		if start+bs < len(buf) {
+			sum = rollSum(sum, bs, buf[start], buf[start+bs])
+		} else {
+			fresh = true
+		}
+		start++
+		if start-lit >= maxLiteral {
+			if err := g.addLiteral(buf[lit:start]); err != nil {
+				return g.literal, err
+			}
+			lit = start
+		}
+	}
+
+	// the tail may be the short last block of the old file
+	tail := buf[start:]
+	last := len(sig.Blocks) - 1
+	if len(tail) > 0 && last >= 0 && sig.blockLen(last) == len(tail) && sig.Blocks[last].Weak == WeakSum(tail) &&
+		sig.Blocks[last].Strong == strongSum(tail) {
+		if err := g.addLiteral(buf[lit:start]); err != nil {
+			return g.literal, err
+		}
+		if err := g.addCopy(last); err != nil {
+			return g.literal, err
+		}
+	} else if err := g.addLiteral(buf[lit:]); err != nil {
+		return g.literal, err
+	}
+
+	if err := g.flush(); err != nil {
+		return g.literal, err
+	}
+	if !g.emitted {
+		return g.literal, emit(nil, 0)
+	}
+	return g.literal, nil
+}
+
+func (g *deltaGen) match(sum uint32, window []byte) int {
+	list, ok := g.table[sum]
+	if !ok {
+		return -1
+	}
+	strong := strongSum(window)
+	for _, idx := range list {
+		if g.sig.Blocks[idx].Strong == strong {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (g *deltaGen) addLiteral(data []byte) error {
+	g.literal += len(data)
+	for len(data) > 0 {
+		room := g.maxBatch - len(g.ops) - deltaLiteralLen
+		if room <= 0 {
+			if err := g.flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if room > len(data) {
+			room = len(data)
+		}
+		var head [deltaLiteralLen]byte
+		head[0] = deltaLiteral
+		binary.BigEndian.PutUint32(head[1:], uint32(room))
+		g.ops = append(append(g.ops, head[:]...), data[:room]...)
+		g.n += room
+		g.lastCopy = -1
+		data = data[room:]
+	}
+	return nil
+}
+
+// consecutive blocks are merged into one op
+func (g *deltaGen) addCopy(idx int) error {
+	if g.lastCopy >= 0 {
+		op := g.ops[g.lastCopy:]
+		first := int(binary.BigEndian.Uint32(op[1:]))
+		count := int(binary.BigEndian.Uint32(op[5:]))
+		if first+count == idx {
+			binary.BigEndian.PutUint32(op[5:], uint32(count+1))
+			g.n += g.sig.blockLen(idx)
+			return nil
+		}
+	}
+
+	if len(g.ops)+deltaCopyLen > g.maxBatch {
+		if err := g.flush(); err != nil {
+			return err
+		}
+	}
+	var op [deltaCopyLen]byte
+	op[0] = deltaCopy
+	binary.BigEndian.PutUint32(op[1:], uint32(idx))
+	binary.BigEndian.PutUint32(op[5:], 1)
+	g.lastCopy = len(g.ops)
+	g.ops = append(g.ops, op[:]...)
+	g.n += g.sig.blockLen(idx)
+	return nil
+}
+
+func (g *deltaGen) flush() error {
+	if len(g.ops) == 0 {
+		return nil
+	}
+	if err := g.emit(g.ops, g.n); err != nil {
+		return err
+	}
+	g.ops = g.ops[:0]
+	g.n = 0
+	g.lastCopy = -1
+	g.emitted = true
+	return nil
+}
+
+// write the new data of ops to w, blocks are read from base of baseSize.
+// returns the length written
+func ApplyDelta(ops []byte, base io.ReaderAt, baseSize int, blockSize int, w io.Writer) (int, error) {
+	n := 0
+	for len(ops) > 0 {
+		switch ops[0] {
+		case deltaCopy:
+			if len(ops) < deltaCopyLen || blockSize <= 0 {
+				return n, ErrDelta
+			}
+			off := int(binary.BigEndian.Uint32(ops[1:])) * blockSize
+			count := int(binary.BigEndian.Uint32(ops[5:]))
+			l := count * blockSize
+			if off+l > baseSize {
+				l = baseSize - off // only the last block is short
+			}
+			if count == 0 || off >= baseSize || l <= (count-1)*blockSize {
+				return n, ErrDelta
+			}
+			nw, err := io.Copy(w, io.NewSectionReader(base, int64(off), int64(l)))
+			n += int(nw)
+			if err == nil && int(nw) != l {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return n, err
+			}
+			ops = ops[deltaCopyLen:]
+		case deltaLiteral:
+			if len(ops) < deltaLiteralLen {
+				return n, ErrDelta
+			}
+			l := int(binary.BigEndian.Uint32(ops[1:]))
+			if len(ops) < deltaLiteralLen+l {
+				return n, ErrDelta
+			}
+			nw, err := w.Write(ops[deltaLiteralLen : deltaLiteralLen+l])
+			n += nw
+			if err != nil {
+				return n, err
+			}
+			ops = ops[deltaLiteralLen+l:]
+		default:
+			return n, ErrDelta
+		}
+	}
+	return n, nil
+}
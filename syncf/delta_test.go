@@ -0,0 +1,78 @@
+package syncf
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func deltaRoundTrip(t *testing.T, old, cur []byte, blockSize, maxBatch int) int {
+	sig, err := MakeSignature(bytes.NewReader(old), len(old), blockSize)
+	if err != nil {
+		t.Fatal("MakeSignature failed", err)
+	}
+	sig, err = DecodeSignature(sig.Encode())
+	if err != nil {
+		t.Fatal("DecodeSignature failed", err)
+	}
+
+	var out bytes.Buffer
+	total := 0
+	literal, err := GenDelta(sig, bytes.NewReader(cur), maxBatch, func(ops []byte, n int) error {
+		if len(ops) > maxBatch {
+			t.Fatal("batch too large", len(ops))
+		}
+		nw, err := ApplyDelta(ops, bytes.NewReader(old), len(old), blockSize, &out)
+		if err != nil || nw != n {
+			t.Fatal("ApplyDelta failed", nw, n, err)
+		}
+		total += n
+		return nil
+	})
+	if err != nil || total != len(cur) || !bytes.Equal(out.Bytes(), cur) {
+		t.Fatal("delta not equal", total, len(cur), err)
+	}
+	return literal
+}
+
+func TestDelta(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	old := make([]byte, 300*1024+123)
+	rnd.Read(old)
+
+	// pages changed in the middle
+	cur := append([]byte(nil), old...)
+	copy(cur[100000:], []byte("changed page"))
+	copy(cur[200000:], []byte("another"))
+	if literal := deltaRoundTrip(t, old, cur, 1024, 4096); literal > 2*1024 {
+		t.Fatal("too much literal data", literal)
+	}
+
+	// insert, remove and truncate
+	cur = append(append(append([]byte(nil), old[:5000]...), []byte("inserted")...), old[5000:]...)
+	cur = append(cur[:150000], cur[160000:]...)
+	if literal := deltaRoundTrip(t, old, cur, 1024, 4096); literal > 3*1024 {
+		t.Fatal("too much literal data", literal)
+	}
+	deltaRoundTrip(t, old, old[:70001], 1024, 100)
+
+	// no data in common, empty old and new file
+	other := make([]byte, 50000)
+	rnd.Read(other)
+	deltaRoundTrip(t, old, other, 2048, 1000)
+	deltaRoundTrip(t, nil, other, 1024, 1000)
+	deltaRoundTrip(t, old, nil, 1024, 1000)
+	if literal := deltaRoundTrip(t, old, old, 1024, 64); literal != 0 {
+		t.Fatal("same file with literal data", literal)
+	}
+}
+
+func TestApplyDeltaInvalid(t *testing.T) {
+	old := make([]byte, 3000)
+	var out bytes.Buffer
+	for _, ops := range [][]byte{{'C', 0, 0, 0, 3, 0, 0, 0, 1}, {'C', 0, 0, 0, 1, 0, 0, 0, 3}, {'L', 0, 0, 0, 9, 1}, {'X'}} {
+		if _, err := ApplyDelta(ops, bytes.NewReader(old), len(old), 1024, &out); err == nil {
+			t.Fatal("invalid ops applied", ops)
+		}
+	}
+}
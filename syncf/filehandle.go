@@ -1,7 +1,11 @@
 package syncf
 
 import (
+	"crypto/sha256"
 	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -18,20 +22,33 @@ const (
 	FileWriteErr
 	FileUsing
 	FilePosErr
+	ReqInvalid
+	ChecksumErr
+	DigestErr
+	StreamLimit
+	LinkTargetErr
+	AuthFailed
+	PathDenied
+	PathInvalid
 )
 
 const (
-	FileInfoCanUse int = iota
-	FileInfoUsing
-	FileInfoNo
+	HashBlockSize = 64 * 1024 // block of client hash cache and patch
 )
 
 var (
-	FileOprErr = []byte{'0', '1', '2', '3', '4', '5', '6', '7'}
+	ErrIsDir = errors.New("it's dir")
+)
+
+const (
+	FileInfoCanUse int = iota
+	FileInfoUsing
+	FileInfoNo
 )
 
 type FileHandleInfo struct {
 	File *os.File
+	Digest *FileDigest // of the data written through File, nil if not known
 	time time.Time
 	bUse bool
 }
@@ -85,12 +102,18 @@ func CreateFilePathF(fileName string) bool {
 
 
 func (fileHandleMap *FileHandleMap) AddFileHandleInfo(fileName string, file *os.File) bool {
+	return fileHandleMap.AddFileHandleDigest(fileName, file, nil)
+}
+
+// add handle with the digest of the data written through it
+func (fileHandleMap *FileHandleMap) AddFileHandleDigest(fileName string, file *os.File, digest *FileDigest) bool {
 	fileHandleMap.Lock()
 	defer fileHandleMap.Unlock()
 
 	if _, isExist := fileHandleMap.Map[fileName]; !isExist {
 		fileInfo := new(FileHandleInfo)
 		fileInfo.File = file
+		fileInfo.Digest = digest
 		fileInfo.time = time.Now()
 		fileInfo.bUse = false
 		fileHandleMap.Map[fileName] = fileInfo
@@ -111,6 +134,43 @@ func (fileHandleMap *FileHandleMap) RemoveFileHandleInfo(fileName string) {
 	}
 }
 
+// remove the handle of a file not written by another request, false if it is
+// in use and kept
+func (fileHandleMap *FileHandleMap) RemoveFreeFileHandleInfo(fileName string) bool {
+	fileHandleMap.Lock()
+	defer fileHandleMap.Unlock()
+
+	if file, isExist := fileHandleMap.Map[fileName]; isExist {
+		if file.bUse {
+			return false
+		}
+		file.File.Close()
+		delete(fileHandleMap.Map, fileName)
+	}
+	return true
+}
+
+// remove handles of files under path, none is removed and false returned if
+// one of them is in use
+func (fileHandleMap *FileHandleMap) RemovePathFileHandleInfo(path string) bool {
+	fileHandleMap.Lock()
+	defer fileHandleMap.Unlock()
+
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for fname, file := range fileHandleMap.Map {
+		if strings.HasPrefix(fname, prefix) && file.bUse {
+			return false
+		}
+	}
+	for fname, file := range fileHandleMap.Map {
+		if strings.HasPrefix(fname, prefix) {
+			file.File.Close()
+			delete(fileHandleMap.Map, fname)
+		}
+	}
+	return true
+}
+
 func (fileHandleMap *FileHandleMap) CheckUnUsedFileHandle(sec int) {
 	timer := time.NewTicker(time.Second * 10)
 	var fileList []string
@@ -166,8 +226,45 @@ func (fileHandleMap *FileHandleMap) PutFileHandleInfo(fInfo *FileHandleInfo) {
 	fInfo.bUse = false
 }
 
-func CheckPosAndWrte(file *os.File, pos int, data []byte) (int, int) {
-	//check pos
+// write data at pos without truncating the data after it, file longer than tolSize is cut
+func PatchWrite(file *os.File, pos int, tolSize int, data []byte) (int, int) {
+	if pos+len(data) > tolSize {
+		return FilePosErr, 0
+	}
+	nw, err := file.WriteAt(data, int64(pos))
+	if err != nil {
+		return FileWriteErr, 0
+	}
+	return cutFile(file, tolSize), nw
+}
+
+// PatchWrite with data read from r
+func PatchCopy(file *os.File, pos int, tolSize int, r io.Reader, buf []byte) (int, int) {
+	if pos > tolSize {
+		return FilePosErr, 0
+	}
+	iRst, nw := CopyAt(file, pos, LimitReader(r, tolSize-pos), buf)
+	if iRst != Succeed {
+		return iRst, nw
+	}
+	return cutFile(file, tolSize), nw
+}
+
+func cutFile(file *os.File, tolSize int) int {
+	stat, err := file.Stat()
+	if err != nil {
+		return FileWriteErr
+	}
+	if int(stat.Size()) > tolSize {
+		if err = file.Truncate(int64(tolSize)); err != nil {
+			return FileWriteErr
+		}
+	}
+	return Succeed
+}
+
+// file is cut to pos if longer, FilePosErr with file size if shorter
+func checkPos(file *os.File, pos int) (int, int) {
 	stfileInfo, err := file.Stat()
 	if err != nil {
 		return FileNotExist, 0
@@ -185,10 +282,18 @@ func CheckPosAndWrte(file *os.File, pos int, data []byte) (int, int) {
 		}
 
 	}
+	return Succeed, 0
+}
+
+func CheckPosAndWrte(file *os.File, pos int, data []byte) (int, int) {
+	//check pos
+	if iRst, iSize := checkPos(file, pos); iRst != Succeed {
+		return iRst, iSize
+	}
 
 	//write data
 	iRst := 0
-	iRst, err = file.WriteAt(data, int64(pos))
+	iRst, err := file.WriteAt(data, int64(pos))
 	if err != nil {
 		return FileWriteErr, 0
 	}
@@ -197,6 +302,36 @@ func CheckPosAndWrte(file *os.File, pos int, data []byte) (int, int) {
 
 }
 
+// CheckPosAndWrte with data read from r
+func CheckPosAndCopy(file *os.File, pos int, r io.Reader, buf []byte) (int, int) {
+	if iRst, iSize := checkPos(file, pos); iRst != Succeed {
+		return iRst, iSize
+	}
+	return CopyAt(file, pos, r, buf)
+}
+
+// copy r to file at pos through buf, return result and length written.
+// ReqInvalid if r failed
+func CopyAt(file *os.File, pos int, r io.Reader, buf []byte) (int, int) {
+	n := 0
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			nw, werr := file.WriteAt(buf[:nr], int64(pos+n))
+			n += nw
+			if werr != nil {
+				return FileWriteErr, n
+			}
+		}
+		if err == io.EOF {
+			return Succeed, n
+		}
+		if err != nil {
+			return ReqInvalid, n
+		}
+	}
+}
+
 func IsDir(path string) bool {
 	s, err := os.Stat(path)
 	if err != nil {
@@ -215,16 +350,36 @@ func GetPathFileStat(path string) (fileStat []FileStat) {
 		return nil
 	}
 	for _, v := range dirList {
-		if v.IsDir() {
-			continue
-		}
 		fname := v.Name()
-		if fname[0] == '.' || strings.Index(fname, " ") >=0 {
+		if fname[0] == '.' {
 			continue
 		}
 
-		file := FileStat{v.Name(), int(v.Size())}
+		file := FileStat{FileName: v.Name(), Ino: FileInode(v), Mode: uint32(v.Mode()), ModTime: v.ModTime().UnixNano()}
+		if v.IsDir() {
+			file.IsDir = true
+		} else if v.Mode()&os.ModeSymlink != 0 {
+			file.Link, _ = os.Readlink(path + "/" + fname)
+		} else {
+			file.Size = int(v.Size())
+		}
+		fileStat = append(fileStat, file)
+	}
+	return fileStat
+}
+
+// files under path at any depth, FileName is the relative path. symlinks to
+// dirs are not followed
+func GetTreeFileStat(path string) (fileStat []FileStat) {
+	for _, file := range GetPathFileStat(path) {
 		fileStat = append(fileStat, file)
+		if !file.IsDir {
+			continue
+		}
+		for _, sub := range GetTreeFileStat(path + "/" + file.FileName) {
+			sub.FileName = file.FileName + "/" + sub.FileName
+			fileStat = append(fileStat, sub)
+		}
 	}
 	return fileStat
 }
@@ -235,17 +390,116 @@ func GetFileStat(fname string) (fileStat FileStat, err error) {
 		return fileStat, err
 	}
 
+	fileStat.FileName = fname
+	fileStat.Mode = uint32(s.Mode())
+	fileStat.ModTime = s.ModTime().UnixNano()
 	if s.IsDir() {
-		return fileStat, errors.New("it's dir")
+		fileStat.IsDir = true
+		return fileStat, ErrIsDir
 	}
 
-	fileStat.FileName = fname
 	fileStat.Size = (int)(s.Size())
+	fileStat.Ino = FileInode(s)
 	return fileStat, err
 
 
 }
 
+// target of symlink fname, false if not a symlink
+func ReadLink(fname string) (string, bool) {
+	s, err := os.Lstat(fname)
+	if err != nil || s.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+	target, err := os.Readlink(fname)
+	return target, err == nil
+}
+
+// sha256 of the first size bytes and crc32c of each HashBlockSize block, in one read
+func FileHashBlocks(file *os.File, size int) ([]byte, []uint32, error) {
+	d := NewFileDigest()
+	if err := d.Update(file, size); err != nil {
+		return nil, nil, err
+	}
+	digest, blocks := d.Sum()
+	return digest, blocks, nil
+}
+
+// sha256 and block crc32c of the head of a file, kept while the file grows so
+// the appended data is hashed only, not the whole file again
+type FileDigest struct {
+	h      hash.Hash
+	size   int
+	blocks []uint32 // of whole blocks
+	tail   uint32   // crc32c of the last partial block
+}
+
+func NewFileDigest() *FileDigest {
+	return &FileDigest{h: sha256.New()}
+}
+
+// length of data hashed
+func (d *FileDigest) Size() int {
+	return d.size
+}
+
+func (d *FileDigest) Reset() {
+	d.h.Reset()
+	d.size = 0
+	d.blocks = d.blocks[:0]
+	d.tail = 0
+}
+
+// hash data following the data hashed
+func (d *FileDigest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.h.Write(p)
+	for len(p) > 0 {
+		l := HashBlockSize - d.size%HashBlockSize
+		if l > len(p) {
+			l = len(p)
+		}
+		d.tail = crc32.Update(d.tail, crc32cTable, p[:l])
+		d.size += l
+		p = p[l:]
+		if d.size%HashBlockSize == 0 {
+			d.blocks = append(d.blocks, d.tail)
+			d.tail = 0
+		}
+	}
+	return n, nil
+}
+
+// hash the first size bytes of file, only the part after Size is read.
+// hashed again from the start if size is less than Size, reset on error
+func (d *FileDigest) Update(file io.ReaderAt, size int) error {
+	if size < d.size {
+		d.Reset()
+	}
+	_, err := io.Copy(d, io.NewSectionReader(file, int64(d.size), int64(size-d.size)))
+	if err == nil && d.size != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		d.Reset()
+	}
+	return err
+}
+
+// sha256 and block hashes of the data hashed
+func (d *FileDigest) Sum() ([]byte, []uint32) {
+	blocks := make([]uint32, len(d.blocks), len(d.blocks)+1)
+	copy(blocks, d.blocks)
+	if d.size%HashBlockSize != 0 {
+		blocks = append(blocks, d.tail)
+	}
+	return d.h.Sum(nil), blocks
+}
+
+func HashBlockCount(size int) int {
+	return (size + HashBlockSize - 1) / HashBlockSize
+}
+
 func GetFileSize(file *os.File) (int, error) {
 	fstat, err := file.Stat()
 	if err != nil {
@@ -1,7 +1,11 @@
 package syncf
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
 	"log"
+	"os"
 	"testing"
 )
 
@@ -9,3 +13,132 @@ func TestFileStat(t *testing.T) {
 	fileStat, err := GetFileStat("./util.go")
 	log.Println(fileStat, err)
 }
+
+func TestPatchWrite(t *testing.T) {
+	file, err := ioutil.TempFile("", "patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	data := bytes.Repeat([]byte("a"), HashBlockSize+10)
+	_, _ = file.Write(data)
+	_, old, err := FileHashBlocks(file, len(data))
+	if err != nil || len(old) != 2 {
+		t.Fatal("FileHashBlocks failed", len(old), err)
+	}
+
+	if iRst, _ := PatchWrite(file, 5, len(data), []byte("bb")); iRst != Succeed {
+		t.Fatal("PatchWrite failed", iRst)
+	}
+	copy(data[5:], "bb")
+	digest, blocks, err := FileHashBlocks(file, len(data))
+	sum := sha256.Sum256(data)
+	if err != nil || blocks[0] == old[0] || blocks[1] != old[1] || !bytes.Equal(digest, sum[:]) {
+		t.Fatal("patch not written at pos", err)
+	}
+
+	if iRst, _ := PatchWrite(file, 0, 3, []byte("c")); iRst != Succeed {
+		t.Fatal("PatchWrite failed", iRst)
+	}
+	if size, _ := GetFileSize(file); size != 3 {
+		t.Fatal("file not cut to tolsize", size)
+	}
+}
+
+func TestCheckPosAndCopy(t *testing.T) {
+	file, err := ioutil.TempFile("", "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	buf := make([]byte, 64) // smaller than the chunk
+	if iRst, nw := CheckPosAndCopy(file, 0, bytes.NewReader(data), buf); iRst != Succeed || nw != len(data) {
+		t.Fatal("CheckPosAndCopy failed", iRst, nw)
+	}
+	if iRst, size := CheckPosAndCopy(file, len(data)+1, bytes.NewReader(data), buf); iRst != FilePosErr || size != len(data) {
+		t.Fatal("pos after file end not detected", iRst, size)
+	}
+
+	// data longer than tolsize of patch
+	if iRst, _ := PatchCopy(file, 10, 20, bytes.NewReader(data), buf); iRst != ReqInvalid {
+		t.Fatal("patch longer than tolsize not detected", iRst)
+	}
+	if iRst, nw := PatchCopy(file, 10, 20, bytes.NewReader([]byte("abc")), buf); iRst != Succeed || nw != 3 {
+		t.Fatal("PatchCopy failed", iRst, nw)
+	}
+	got, _ := ioutil.ReadFile(file.Name())
+	if string(got) != "0123456789abc3456789" {
+		t.Fatal("patch data not equal", string(got))
+	}
+}
+
+func TestFileDigest(t *testing.T) {
+	file, err := ioutil.TempFile("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), HashBlockSize/4)
+	_, _ = file.Write(data)
+	d := NewFileDigest()
+	for _, size := range []int{0, 10, HashBlockSize, HashBlockSize + 1, len(data)} {
+		if err = d.Update(file, size); err != nil {
+			t.Fatal("Update failed", size, err)
+		}
+		digest, blocks := d.Sum()
+		sum := sha256.Sum256(data[:size])
+		if d.Size() != size || !bytes.Equal(digest, sum[:]) || len(blocks) != HashBlockCount(size) {
+			t.Fatal("digest extended not equal", size, len(blocks))
+		}
+		for i, b := range blocks {
+			end := (i + 1) * HashBlockSize
+			if end > size {
+				end = size
+			}
+			if b != Checksum(data[i*HashBlockSize:end]) {
+				t.Fatal("block hash not equal", size, i)
+			}
+		}
+	}
+
+	// shorter file hashed again from start
+	if err = d.Update(file, 5); err != nil || d.Size() != 5 {
+		t.Fatal("Update to shorter size failed", d.Size(), err)
+	}
+	if err = d.Update(file, len(data)+1); err == nil || d.Size() != 0 {
+		t.Fatal("read after file end not detected", d.Size(), err)
+	}
+}
+
+func TestGetTreeFileStat(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"/a/b", "/.hide"} {
+		if err := os.MkdirAll(dir+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"/top.txt", "/a/b/deep.txt", "/.hide/x.txt"} {
+		if err := ioutil.WriteFile(dir+f, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(dir+"/a", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]FileStat)
+	for _, f := range GetTreeFileStat(dir) {
+		names[f.FileName] = f
+	}
+	if len(names) != 5 || !names["a"].IsDir || !names["a/b"].IsDir || names["a/b/deep.txt"].Size != 4 ||
+		names["top.txt"].Size != 4 || len(names["link"].Link) == 0 {
+		t.Fatal("GetTreeFileStat wrong", names)
+	}
+}
@@ -0,0 +1,353 @@
+package syncf
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// binary frame shared by client and server, all integers are big endian
+//
+//	magic(2) version(1) op(1) flags(2) hlen(2) plen(4) | header(hlen) | payload(plen)
+//
+// header: result(1) pathlen(2) path pos(8) tolsize(8) [optional fields]
+// optional fields follow in the order of their flag bits:
+//
+//	FlagChecksum  crc32c of the uncompressed payload(4)
+//	FlagDigest    sha256 of the first tolsize bytes of the file(32), on the last chunk
+//	FlagSeq       sequence of the chunk(4), echoed in the result
+//	FlagStream    stream id(4), echoed in the result
+//	FlagMeta      mode(4) mtime in unix nano(8), on the last chunk
+//	FlagOwner     uid(4) gid(4), on the last chunk
+//	FlagCodec     codec id(1) of the compressed payload, gzip if not set
+//
+// fields appended to the header later are skipped by old decoders through hlen
+
+const (
+	FrameMagic      uint16 = 0x5346 // "SF"
+	FrameVersion    uint8  = 1
+	FrameFixedLen          = 12
+	MaxFramePath           = 4096
+	MaxFramePayload        = 512 * 1024 * 1024
+	DigestSize             = sha256.Size
+)
+
+// frame op code
+const (
+	OpWrite uint8 = iota + 1
+	OpResult
+	OpHello
+	OpHelloAck
+	OpStreamEnd
+	OpDelete
+	OpRename // payload is the new path
+	OpMkdir
+	OpRmdir
+	OpSetMeta
+	OpSymlink // payload is the link target
+	OpSigReq  // pos is the block size
+	OpSigs    // reply of OpSigReq, payload is the signature
+	OpDelta   // pos and tolsize are of the new file, payload is delta ops
+	OpAuth    // path is the client id, payload is Auth, pos of the result is the rate limit of the client
+)
+
+// frame flags
+const (
+	FlagCompress uint16 = 1 << iota
+	FlagChecksum
+	FlagDigest
+	FlagSeq
+	FlagStream
+	FlagMeta
+	FlagOwner
+	FlagPatch // write at pos of existing file without truncate, no field
+	FlagCodec
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrFrameShort   = errors.New("frame not complete")
+	ErrFrameMagic   = errors.New("frame magic error")
+	ErrFrameVersion = errors.New("frame version not support")
+	ErrFrameTooLong = errors.New("frame too long")
+	ErrFrameFormat  = errors.New("frame header format error")
+	ErrFramePath    = errors.New("frame path too long")
+)
+
+type Frame struct {
+	Op       uint8
+	Flags    uint16
+	Result   int
+	Path     string
+	Pos      int
+	TolSize  int
+	Checksum uint32
+	Digest   []byte
+	Seq      uint32
+	Stream   uint32
+	Mode     uint32 // os.FileMode
+	MTime    int64
+	Uid      int
+	Gid      int
+	Codec    uint8
+	Payload  []byte
+}
+
+func (f *Frame) Reset() {
+	*f = Frame{Payload: f.Payload[:0]}
+}
+
+// append encoded frame to dst
+func (f *Frame) Encode(dst []byte) ([]byte, error) {
+	dst, err := f.EncodeHeader(dst)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, f.Payload...), nil
+}
+
+// append fixed part and header to dst, the payload is to be written after it.
+// dst is returned unchanged on error
+func (f *Frame) EncodeHeader(dst []byte) ([]byte, error) {
+	if len(f.Path) > MaxFramePath {
+		return dst, ErrFramePath
+	}
+	if len(f.Payload) > MaxFramePayload {
+		return dst, ErrFrameTooLong
+	}
+	start := len(dst)
+	var fixed [FrameFixedLen]byte
+	binary.BigEndian.PutUint16(fixed[0:], FrameMagic)
+	fixed[2] = FrameVersion
+	fixed[3] = f.Op
+	binary.BigEndian.PutUint16(fixed[4:], f.Flags)
+	binary.BigEndian.PutUint32(fixed[8:], uint32(len(f.Payload)))
+	dst = append(dst, fixed[:]...)
+
+	var num [8]byte
+	dst = append(dst, byte(f.Result))
+	binary.BigEndian.PutUint16(num[:2], uint16(len(f.Path)))
+	dst = append(dst, num[:2]...)
+	dst = append(dst, f.Path...)
+	binary.BigEndian.PutUint64(num[:], uint64(f.Pos))
+	dst = append(dst, num[:]...)
+	binary.BigEndian.PutUint64(num[:], uint64(f.TolSize))
+	dst = append(dst, num[:]...)
+
+	if f.Flags&FlagChecksum != 0 {
+		binary.BigEndian.PutUint32(num[:4], f.Checksum)
+		dst = append(dst, num[:4]...)
+	}
+	if f.Flags&FlagDigest != 0 {
+		dst = append(dst, f.Digest[:DigestSize]...)
+	}
+	if f.Flags&FlagSeq != 0 {
+		binary.BigEndian.PutUint32(num[:4], f.Seq)
+		dst = append(dst, num[:4]...)
+	}
+	if f.Flags&FlagStream != 0 {
+		binary.BigEndian.PutUint32(num[:4], f.Stream)
+		dst = append(dst, num[:4]...)
+	}
+	if f.Flags&FlagMeta != 0 {
+		binary.BigEndian.PutUint32(num[:4], f.Mode)
+		dst = append(dst, num[:4]...)
+		binary.BigEndian.PutUint64(num[:], uint64(f.MTime))
+		dst = append(dst, num[:]...)
+	}
+	if f.Flags&FlagOwner != 0 {
+		binary.BigEndian.PutUint32(num[:4], uint32(f.Uid))
+		dst = append(dst, num[:4]...)
+		binary.BigEndian.PutUint32(num[:4], uint32(f.Gid))
+		dst = append(dst, num[:4]...)
+	}
+	if f.Flags&FlagCodec != 0 {
+		dst = append(dst, f.Codec)
+	}
+
+	hlen := len(dst) - start - FrameFixedLen
+	binary.BigEndian.PutUint16(dst[start+6:], uint16(hlen))
+	return dst, nil
+}
+
+// check the fixed part, return header and payload length
+func decodeFixed(buf []byte) (hlen int, plen int, err error) {
+	if binary.BigEndian.Uint16(buf[0:]) != FrameMagic {
+		return 0, 0, ErrFrameMagic
+	}
+	if buf[2] != FrameVersion {
+		return 0, 0, ErrFrameVersion
+	}
+	hlen = int(binary.BigEndian.Uint16(buf[6:]))
+	plen = int(binary.BigEndian.Uint32(buf[8:]))
+	if plen > MaxFramePayload {
+		return 0, 0, ErrFrameTooLong
+	}
+	return hlen, plen, nil
+}
+
+func decodeHeader(buf []byte, f *Frame) error {
+	if len(buf) < 3 {
+		return ErrFrameFormat
+	}
+	f.Result = int(buf[0])
+	pathLen := int(binary.BigEndian.Uint16(buf[1:]))
+	if pathLen > MaxFramePath || len(buf) < 3+pathLen+16 {
+		return ErrFrameFormat
+	}
+	f.Path = string(buf[3 : 3+pathLen])
+	buf = buf[3+pathLen:]
+	f.Pos = int(int64(binary.BigEndian.Uint64(buf[0:])))
+	f.TolSize = int(int64(binary.BigEndian.Uint64(buf[8:])))
+	if f.Pos < 0 || f.TolSize < 0 {
+		return ErrFrameFormat
+	}
+	buf = buf[16:]
+
+	if f.Flags&FlagChecksum != 0 {
+		if len(buf) < 4 {
+			return ErrFrameFormat
+		}
+		f.Checksum = binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+	}
+	if f.Flags&FlagDigest != 0 {
+		if len(buf) < DigestSize {
+			return ErrFrameFormat
+		}
+		f.Digest = buf[:DigestSize]
+		buf = buf[DigestSize:]
+	}
+	if f.Flags&FlagSeq != 0 {
+		if len(buf) < 4 {
+			return ErrFrameFormat
+		}
+		f.Seq = binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+	}
+	if f.Flags&FlagStream != 0 {
+		if len(buf) < 4 {
+			return ErrFrameFormat
+		}
+		f.Stream = binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+	}
+	if f.Flags&FlagMeta != 0 {
+		if len(buf) < 12 {
+			return ErrFrameFormat
+		}
+		f.Mode = binary.BigEndian.Uint32(buf)
+		f.MTime = int64(binary.BigEndian.Uint64(buf[4:]))
+		buf = buf[12:]
+	}
+	if f.Flags&FlagOwner != 0 {
+		if len(buf) < 8 {
+			return ErrFrameFormat
+		}
+		f.Uid = int(binary.BigEndian.Uint32(buf))
+		f.Gid = int(binary.BigEndian.Uint32(buf[4:]))
+		buf = buf[8:]
+	}
+	if f.Flags&FlagCodec != 0 {
+		if len(buf) < 1 {
+			return ErrFrameFormat
+		}
+		f.Codec = buf[0]
+		buf = buf[1:]
+	}
+	return nil
+}
+
+// decode one frame from buf, f.Payload and f.Digest refer to buf
+// return the frame length, ErrFrameShort if buf not include a whole frame.
+// with ErrFrameFormat the length is still valid, the frame can be skipped
+func DecodeFrame(buf []byte, f *Frame) (int, error) {
+	if len(buf) < FrameFixedLen {
+		return 0, ErrFrameShort
+	}
+	hlen, plen, err := decodeFixed(buf)
+	if err != nil {
+		return 0, err
+	}
+	n := FrameFixedLen + hlen + plen
+	if len(buf) < n {
+		return 0, ErrFrameShort
+	}
+
+	*f = Frame{Op: buf[3], Flags: binary.BigEndian.Uint16(buf[4:])}
+	if err = decodeHeader(buf[FrameFixedLen:FrameFixedLen+hlen], f); err != nil {
+		return n, err
+	}
+	f.Payload = buf[FrameFixedLen+hlen : n]
+	return n, nil
+}
+
+// read one frame from r, buf is used to hold the frame and returned for reuse
+func ReadFrame(r io.Reader, f *Frame, buf []byte) ([]byte, error) {
+	if cap(buf) < FrameFixedLen {
+		buf = make([]byte, FrameFixedLen, 256)
+	}
+	buf = buf[:FrameFixedLen]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return buf, err
+	}
+	hlen, plen, err := decodeFixed(buf)
+	if err != nil {
+		return buf, err
+	}
+
+	n := FrameFixedLen + hlen + plen
+	if cap(buf) < n {
+		buf = append(buf, make([]byte, n-FrameFixedLen)...)
+	}
+	buf = buf[:n]
+	if _, err = io.ReadFull(r, buf[FrameFixedLen:]); err != nil {
+		return buf, err
+	}
+
+	_, err = DecodeFrame(buf, f)
+	return buf, err
+}
+
+// read the fixed part and header of one frame from r, the payload of plen bytes
+// is left in r. f.Digest refers to buf, buf is returned for reuse.
+// with ErrFrameFormat plen is still valid, the payload can be skipped
+func ReadFrameHeader(r io.Reader, f *Frame, buf []byte) ([]byte, int, error) {
+	if cap(buf) < FrameFixedLen {
+		buf = make([]byte, FrameFixedLen, 256)
+	}
+	buf = buf[:FrameFixedLen]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return buf, 0, err
+	}
+	hlen, plen, err := decodeFixed(buf)
+	if err != nil {
+		return buf, 0, err
+	}
+
+	n := FrameFixedLen + hlen
+	if cap(buf) < n {
+		buf = append(buf, make([]byte, hlen)...)
+	}
+	buf = buf[:n]
+	if _, err = io.ReadFull(r, buf[FrameFixedLen:]); err != nil {
+		return buf, 0, err
+	}
+
+	*f = Frame{Op: buf[3], Flags: binary.BigEndian.Uint16(buf[4:])}
+	return buf, plen, decodeHeader(buf[FrameFixedLen:], f)
+}
+
+// crc32c of chunk data
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32cTable)
+}
+
+// Checksum of data written to the hash
+func NewChecksum() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
@@ -0,0 +1,64 @@
+package syncf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameEncodeDecode(t *testing.T) {
+	src := Frame{Op: OpWrite, Flags: FlagCompress | FlagChecksum, Path: "/dir with space/new\nline/文件.txt",
+		Pos: 1 << 40, TolSize: 12, Payload: []byte("hello world!")}
+	src.Checksum = Checksum(src.Payload)
+	buf, err := src.Encode(nil)
+	if err != nil {
+		t.Fatal("Encode failed", err)
+	}
+
+	var dst Frame
+	if _, err := DecodeFrame(buf[:len(buf)-1], &dst); err != ErrFrameShort {
+		t.Fatal("short frame not detected", err)
+	}
+
+	n, err := DecodeFrame(append(buf, 'x'), &dst)
+	if err != nil || n != len(buf) {
+		t.Fatal("DecodeFrame failed", n, err)
+	}
+	if dst.Op != src.Op || dst.Flags != src.Flags || dst.Path != src.Path || dst.Pos != src.Pos ||
+		dst.TolSize != src.TolSize || dst.Checksum != src.Checksum || !bytes.Equal(dst.Payload, src.Payload) {
+		t.Fatal("frame not equal", dst)
+	}
+
+	var rd Frame
+	if _, err = ReadFrame(bytes.NewReader(buf), &rd, nil); err != nil || rd.Path != src.Path {
+		t.Fatal("ReadFrame failed", err, rd.Path)
+	}
+
+	r := bytes.NewReader(buf)
+	_, plen, err := ReadFrameHeader(r, &rd, nil)
+	if err != nil || plen != len(src.Payload) || rd.Path != src.Path || r.Len() != plen {
+		t.Fatal("ReadFrameHeader failed", err, plen, r.Len())
+	}
+}
+
+func TestFrameInvalid(t *testing.T) {
+	buf, _ := (&Frame{Op: OpWrite, Path: "/a"}).Encode(nil)
+	buf[0] = 'x'
+	var f Frame
+	if _, err := DecodeFrame(buf, &f); err != ErrFrameMagic {
+		t.Fatal("bad magic not detected", err)
+	}
+
+	// path length larger than header, frame can be skipped
+	buf, _ = (&Frame{Op: OpWrite, Path: "/a"}).Encode(nil)
+	buf[FrameFixedLen+2] = 100
+	n, err := DecodeFrame(buf, &f)
+	if err != ErrFrameFormat || n != len(buf) {
+		t.Fatal("bad header not detected", n, err)
+	}
+
+	// path over 64KiB must not be truncated into the 2 byte length
+	long := Frame{Op: OpWrite, Path: string(bytes.Repeat([]byte("a"), 1<<16+1))}
+	if buf, err = long.Encode([]byte("x")); err != ErrFramePath || len(buf) != 1 {
+		t.Fatal("long path not refused", len(buf), err)
+	}
+}
@@ -0,0 +1,169 @@
+package syncf
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// protocol version, 1 is the frame protocol without hello
+const (
+	ProtoVersion   = 2
+	LegacyMaxChunk = 200 * 1024 * 1024
+)
+
+const (
+	CodecGzip = "gzip"
+)
+
+const (
+	FeatureChecksum = "crc32c"
+	FeatureDigest   = "sha256"
+	FeatureWindow   = "window"
+	FeatureMux      = "mux"
+	FeatureDelete   = "delete"
+	FeatureRename   = "rename"
+	FeatureDir      = "dir"
+	FeatureMeta     = "meta"
+	FeatureSymlink  = "symlink"
+	FeatureDelta    = "delta"
+	FeaturePatch    = "patch"
+	FeatureAuth     = "auth" // added by a client with credential and a server requires OpAuth
+)
+
+var (
+	SupportCodecs   = []string{CodecZstd, CodecLz4, CodecSnappy, CodecGzip}
+	SupportFeatures = []string{FeatureChecksum, FeatureDigest, FeatureWindow, FeatureMux,
+		FeatureDelete, FeatureRename, FeatureDir, FeatureMeta, FeatureSymlink,
+		FeatureDelta, FeaturePatch}
+
+	// capability of a peer which does not send hello
+	LegacyHello = Hello{Version: 1, Codecs: []string{CodecGzip}, MaxChunk: LegacyMaxChunk, MaxStreams: 1}
+
+	// a server from before frames drops the connection on a frame. it serves
+	// no new client, servers are upgraded first
+	ErrTextServer = errors.New("server closed connection on hello, server of text protocol not supported")
+)
+
+// capability exchanged on connect, the result of negotiation has the same type
+type Hello struct {
+	Version  int      `json:"version"`
+	Codecs   []string `json:"codecs"`
+	MaxChunk int      `json:"maxchunk"`
+	Features []string `json:"features"`
+
+	MaxStreams   int `json:"maxstreams"`   // streams on one connection
+	StreamWindow int `json:"streamwindow"` // chunks in flight of one stream
+
+	Challenge string `json:"challenge,omitempty"` // of hello ack, not negotiated
+	RateLimit int    `json:"ratelimit,omitempty"` // of hello ack, bytes/s the server reads from the client
+}
+
+func NewHello(maxChunk int) Hello {
+	return Hello{Version: ProtoVersion, Codecs: SupportCodecs, MaxChunk: maxChunk, Features: SupportFeatures}
+}
+
+func (h *Hello) HasCodec(codec string) bool {
+	return inStrings(h.Codecs, codec)
+}
+
+func (h *Hello) HasFeature(feature string) bool {
+	return inStrings(h.Features, feature)
+}
+
+// common subset of local and remote, keep the order of local
+func NegotiateHello(local Hello, remote Hello) Hello {
+	var rst Hello
+	rst.Version = local.Version
+	if remote.Version < rst.Version {
+		rst.Version = remote.Version
+	}
+
+	rst.MaxChunk = minPositive(local.MaxChunk, remote.MaxChunk)
+	rst.MaxStreams = minPositive(local.MaxStreams, remote.MaxStreams)
+	rst.StreamWindow = minPositive(local.StreamWindow, remote.StreamWindow)
+
+	for _, v := range local.Codecs {
+		if remote.HasCodec(v) {
+			rst.Codecs = append(rst.Codecs, v)
+		}
+	}
+	for _, v := range local.Features {
+		if remote.HasFeature(v) {
+			rst.Features = append(rst.Features, v)
+		}
+	}
+	return rst
+}
+
+// ends with a newline, a server of text protocol takes the hello as a bad
+// header line and closes the connection at once
+func (h *Hello) Encode() []byte {
+	data, _ := json.Marshal(h)
+	return append(data, '\n')
+}
+
+func DecodeHello(data []byte) (Hello, error) {
+	var h Hello
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, err
+	}
+	if h.Version < 1 {
+		return h, errors.New("hello version error")
+	}
+	return h, nil
+}
+
+// send hello on a new connection, a server without hello answers ReqInvalid
+func (cn *Connection) Handshake(local Hello) error {
+	hello := Frame{Op: OpHello, Payload: local.Encode()}
+	buf, err := hello.Encode(nil)
+	if err != nil {
+		return err
+	}
+	cn.ExtendDeadline()
+	if _, err = cn.Conn.Write(buf); err != nil {
+		return err
+	}
+
+	var rsp Frame
+	cn.ExtendDeadline()
+	if _, err := ReadFrame(cn.Conn, &rsp, nil); err == io.EOF {
+		return ErrTextServer
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case rsp.Op == OpHelloAck:
+		remote, err := DecodeHello(rsp.Payload)
+		if err != nil {
+			return err
+		}
+		cn.Caps = NegotiateHello(local, remote)
+		cn.challenge = remote.Challenge
+		cn.RateLimit = remote.RateLimit
+	case rsp.Op == OpResult && rsp.Result == ReqInvalid:
+		cn.Caps = NegotiateHello(local, LegacyHello)
+	default:
+		return errors.New("hello rsp error")
+	}
+	return nil
+}
+
+// min of a and b, the one not set is ignored
+func minPositive(a int, b int) int {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func inStrings(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
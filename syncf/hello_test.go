@@ -0,0 +1,21 @@
+package syncf
+
+import (
+	"testing"
+)
+
+func TestNegotiateHello(t *testing.T) {
+	local := Hello{Version: 3, Codecs: []string{"zstd", CodecGzip}, MaxChunk: 100, Features: []string{"a", "b"}}
+	remote := Hello{Version: 2, Codecs: []string{CodecGzip}, MaxChunk: 50, Features: []string{"b", "c"}}
+
+	rst := NegotiateHello(local, remote)
+	if rst.Version != 2 || rst.MaxChunk != 50 || len(rst.Codecs) != 1 || !rst.HasCodec(CodecGzip) ||
+		len(rst.Features) != 1 || !rst.HasFeature("b") {
+		t.Fatal("NegotiateHello failed", rst)
+	}
+
+	rst = NegotiateHello(local, LegacyHello)
+	if rst.Version != 1 || rst.MaxChunk != 100 || len(rst.Features) != 0 {
+		t.Fatal("NegotiateHello with legacy failed", rst)
+	}
+}
@@ -0,0 +1,134 @@
+package syncf
+
+import (
+	"net"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// kcp over udp, for lossy links where tcp stalls. fec shards must be the
+// same on client and server, other params are of each side. zero params are
+// defaults, a negative shard count disables fec
+
+const (
+	DefaultKCPDataShards   = 10
+	DefaultKCPParityShards = 3
+	DefaultKCPWindow       = 1024 // packets
+	DefaultKCPMTU          = 1350
+	DefaultKCPInterval     = 20 // ms
+	DefaultKCPResend       = 2
+	DefaultKCPSockBuf      = 4 * 1024 * 1024
+	DefaultKCPIdleTimeout  = 600 // s
+)
+
+type KCPConfig struct {
+	DataShards   int  `json:"DataShards"`
+	ParityShards int  `json:"ParityShards"`
+	SndWnd       int  `json:"SndWnd"`
+	RcvWnd       int  `json:"RcvWnd"`
+	MTU          int  `json:"MTU"`
+	Interval     int  `json:"Interval"`    // ms of the update loop
+	Resend       int  `json:"Resend"`      // fast resend after acks skipped, -1 off
+	NoDelay      int  `json:"NoDelay"`     // 1 not wait the rto timer, -1 off
+	Congestion   bool `json:"Congestion"`  // congestion control, default off
+	SockBuf      int  `json:"SockBuf"`     // udp socket buffer
+	IdleTimeout  int  `json:"IdleTimeout"` // s, server closes a silent session, kcp has no close packet
+	DSCP         int  `json:"DSCP"`
+}
+
+// copy with defaults set
+func (c *KCPConfig) withDefault() KCPConfig {
+	var cfg KCPConfig
+	if c != nil {
+		cfg = *c
+	}
+	setDefault(&cfg.DataShards, DefaultKCPDataShards)
+	setDefault(&cfg.ParityShards, DefaultKCPParityShards)
+	setDefault(&cfg.SndWnd, DefaultKCPWindow)
+	setDefault(&cfg.RcvWnd, DefaultKCPWindow)
+	setDefault(&cfg.MTU, DefaultKCPMTU)
+	setDefault(&cfg.Interval, DefaultKCPInterval)
+	setDefault(&cfg.Resend, DefaultKCPResend)
+	setDefault(&cfg.NoDelay, 1)
+	setDefault(&cfg.SockBuf, DefaultKCPSockBuf)
+	setDefault(&cfg.IdleTimeout, DefaultKCPIdleTimeout)
+	if cfg.DataShards < 0 || cfg.ParityShards < 0 {
+		cfg.DataShards, cfg.ParityShards = 0, 0
+	}
+	if cfg.Resend < 0 {
+		cfg.Resend = 0
+	}
+	if cfg.NoDelay < 0 {
+		cfg.NoDelay = 0
+	}
+	return cfg
+}
+
+func setDefault(v *int, def int) {
+	if *v == 0 {
+		*v = def
+	}
+}
+
+// idle time of a session on server
+func (c *KCPConfig) Idle() time.Duration {
+	cfg := c.withDefault()
+	return time.Duration(cfg.IdleTimeout) * time.Second
+}
+
+func (c *KCPConfig) tune(s *kcp.UDPSession) {
+	nc := 1
+	if c.Congestion {
+		nc = 0
+	}
+	s.SetStreamMode(true)
+	s.SetWriteDelay(false)
+	s.SetNoDelay(c.NoDelay, c.Interval, c.Resend, nc)
+	s.SetWindowSize(c.SndWnd, c.RcvWnd)
+	s.SetMtu(c.MTU)
+	s.SetACKNoDelay(true)
+}
+
+func DialKCP(addr string, c *KCPConfig) (net.Conn, error) {
+	cfg := c.withDefault()
+	s, err := kcp.DialWithOptions(addr, nil, cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	cfg.tune(s)
+	_ = s.SetReadBuffer(cfg.SockBuf)
+	_ = s.SetWriteBuffer(cfg.SockBuf)
+	if cfg.DSCP > 0 {
+		_ = s.SetDSCP(cfg.DSCP)
+	}
+	return s, nil
+}
+
+type kcpListener struct {
+	*kcp.Listener
+	cfg KCPConfig
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	s, err := l.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	l.cfg.tune(s)
+	return s, nil
+}
+
+func ListenKCP(addr string, c *KCPConfig) (net.Listener, error) {
+	cfg := c.withDefault()
+	l, err := kcp.ListenWithOptions(addr, nil, cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	_ = l.SetReadBuffer(cfg.SockBuf)
+	_ = l.SetWriteBuffer(cfg.SockBuf)
+	if cfg.DSCP > 0 {
+		_ = l.SetDSCP(cfg.DSCP)
+	}
+	return &kcpListener{Listener: l, cfg: cfg}, nil
+}
@@ -0,0 +1,312 @@
+package syncf
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// many file streams on one Connection, server acks are dispatched by stream id.
+// with a server without mux, a MuxConn carries only one stream at a time.
+//
+// a stream timed out is ended alone, its late acks are dropped. a stream not
+// taking its acks holds the reader, and so the connection, instead of losing
+// them. the server handles the requests of a connection one by one, a request
+// it takes long on delays the acks of all streams on the connection.
+//
+// a server with rate limit reads the frames of a client no faster than it, the
+// write and recv deadlines of a stream are later by the time the server takes
+// to read the frames sent before
+
+var (
+	ErrMuxClosed    = errors.New("mux connection closed")
+	ErrRecvTimeout  = errors.New("stream recv timeout")
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+type MuxConn struct {
+	cn         *Connection
+	maxStreams int
+	mux        bool
+
+	wlk  sync.Mutex // one frame write at a time
+	wbuf []byte
+
+	lk       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	err      error
+	idleTime time.Time
+}
+
+type Stream struct {
+	ID     uint32
+	Caps   *Hello
+	Window int // chunks in flight allowed
+	mc     *MuxConn
+	rsp    chan *Frame
+	done   chan struct{} // closed when the stream ends, err tells why
+	err    error
+	due    time.Time // frames sent are read by server with rate limit
+}
+
+type MuxPool struct {
+	Pool  *ConnPool // dial and handshake
+	lk    sync.Mutex
+	dlk   sync.Mutex // dial one connection at a time
+	conns map[string][]*MuxConn
+}
+
+func newMuxConn(cn *Connection) *MuxConn {
+	mc := &MuxConn{cn: cn, maxStreams: 1, streams: make(map[uint32]*Stream), idleTime: time.Now()}
+	if cn.Caps.HasFeature(FeatureMux) && cn.Caps.MaxStreams > 1 {
+		mc.mux = true
+		mc.maxStreams = cn.Caps.MaxStreams
+	}
+	// reader waits for acks all the time, stream recv has its own timeout
+	_ = cn.Conn.SetReadDeadline(time.Time{})
+	go mc.readLoop()
+	return mc
+}
+
+func (mc *MuxConn) readLoop() {
+	for {
+		f := new(Frame)
+		if _, err := ReadFrame(mc.cn.Conn, f, nil); err != nil {
+			mc.fail(err)
+			return
+		}
+
+		mc.dispatch(f)
+	}
+}
+
+func (mc *MuxConn) dispatch(f *Frame) {
+	mc.lk.Lock()
+	var s *Stream
+	if mc.mux && f.Flags&FlagStream != 0 {
+		s = mc.streams[f.Stream]
+	} else if !mc.mux {
+		for _, v := range mc.streams {
+			s = v
+		}
+	}
+	mc.lk.Unlock()
+	if s == nil {
+		// stream closed before its acks arrive
+		return
+	}
+
+	// wait for the stream to take it, the server is held by flow control meanwhile
+	select {
+	case s.rsp <- f:
+	case <-s.done:
+	}
+}
+
+// close connection, all streams on it get error
+func (mc *MuxConn) fail(err error) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+	if mc.err != nil {
+		return
+	}
+	mc.err = err
+	_ = mc.cn.Conn.Close()
+	for _, s := range mc.streams {
+		mc.endStream(s, ErrMuxClosed)
+	}
+	mc.streams = make(map[uint32]*Stream)
+}
+
+// recv of stream gets err, acks to it are dropped. the stream keeps its place
+// until closed, the server counts it till then. mc.lk must be held
+func (mc *MuxConn) endStream(s *Stream, err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+}
+
+func (mc *MuxConn) openStream() *Stream {
+	if mc.err != nil || len(mc.streams) >= mc.maxStreams {
+		return nil
+	}
+
+	mc.nextID++
+	s := &Stream{ID: mc.nextID, Caps: &mc.cn.Caps, Window: 1, mc: mc}
+	if s.Caps.HasFeature(FeatureWindow) && s.Caps.StreamWindow > 1 {
+		s.Window = s.Caps.StreamWindow
+	}
+	s.rsp = make(chan *Frame, s.Window+1)
+	s.done = make(chan struct{})
+	mc.streams[s.ID] = s
+	return s
+}
+
+// send one frame on stream
+func (s *Stream) Send(f *Frame) error {
+	mc := s.mc
+	if s.mc.mux {
+		f.Flags |= FlagStream
+		f.Stream = s.ID
+	}
+
+	mc.wlk.Lock()
+	defer mc.wlk.Unlock()
+	// payload written from its own buffer, not copied. nothing is written for
+	// a frame that can not be encoded, the connection is still good
+	var err error
+	if mc.wbuf, err = f.EncodeHeader(mc.wbuf[:0]); err != nil {
+		return err
+	}
+	bufs := net.Buffers{mc.wbuf, f.Payload}
+	s.due = time.Now().Add(mc.cn.ingress.Delay(len(mc.wbuf) + len(f.Payload)))
+	_ = mc.cn.Conn.SetWriteDeadline(s.due.Add(mc.cn.cpool.RWTimeout))
+	if _, err := bufs.WriteTo(mc.cn.Conn); err != nil {
+		mc.fail(err)
+		return err
+	}
+	return nil
+}
+
+// wait one ack of stream
+func (s *Stream) Recv() (*Frame, error) {
+	return s.RecvWait(0)
+}
+
+// wait one ack longer than RWTimeout by extra, for a request the server takes
+// long to answer
+func (s *Stream) RecvWait(extra time.Duration) (*Frame, error) {
+	wait := s.mc.cn.cpool.RWTimeout + extra
+	if d := time.Until(s.due); d > 0 {
+		wait += d
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case f := <-s.rsp:
+		return f, nil
+	case <-s.done:
+		return nil, s.err
+	case <-timer.C:
+	}
+
+	// late acks of a mux stream are dropped by id, without mux they would go
+	// to the next stream on the connection
+	mc := s.mc
+	if !mc.mux {
+		mc.fail(ErrRecvTimeout)
+		return nil, ErrRecvTimeout
+	}
+	mc.lk.Lock()
+	mc.endStream(s, ErrRecvTimeout)
+	mc.lk.Unlock()
+	return nil, ErrRecvTimeout
+}
+
+func (s *Stream) RemoteAddr() string {
+	return s.mc.cn.Addr
+}
+
+// close stream, with acks still in flight a connection without mux can not be used again
+func (s *Stream) Close(pending bool) {
+	mc := s.mc
+	if pending && !mc.mux {
+		mc.fail(errors.New("stream closed with acks pending"))
+		return
+	}
+
+	if mc.mux {
+		end := Frame{Op: OpStreamEnd}
+		_ = s.Send(&end)
+	}
+
+	mc.lk.Lock()
+	mc.endStream(s, ErrStreamClosed)
+	if _, ok := mc.streams[s.ID]; ok {
+		delete(mc.streams, s.ID)
+		if len(mc.streams) == 0 {
+			mc.idleTime = time.Now()
+		}
+	}
+	mc.lk.Unlock()
+}
+
+func (p *MuxPool) getFreeStream(addr string) *Stream {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if p.conns == nil {
+		p.conns = make(map[string][]*MuxConn)
+	}
+	for _, mc := range p.conns[addr] {
+		mc.lk.Lock()
+		s := mc.openStream()
+		mc.lk.Unlock()
+		if s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// get a stream on any connection of addr with free stream, dial a new one if none
+func (p *MuxPool) OpenStream(addr string) (*Stream, error) {
+	if s := p.getFreeStream(addr); s != nil {
+		return s, nil
+	}
+
+	// avoid many uploads dial at the same time
+	p.dlk.Lock()
+	defer p.dlk.Unlock()
+	if s := p.getFreeStream(addr); s != nil {
+		return s, nil
+	}
+
+	cn, err := p.Pool.Get(addr)
+	if err != nil {
+		return nil, err
+	}
+	mc := newMuxConn(cn)
+	mc.lk.Lock()
+	s := mc.openStream()
+	mc.lk.Unlock()
+
+	p.lk.Lock()
+	p.conns[addr] = append(p.conns[addr], mc)
+	p.lk.Unlock()
+	return s, nil
+}
+
+// close connections broken or without stream for sec seconds
+func (p *MuxPool) CheckIdleConn(sec int) {
+	timer := time.NewTicker(time.Second * 10)
+	for {
+		select {
+		case <-timer.C:
+			p.lk.Lock()
+			now := time.Now()
+			for addr, list := range p.conns {
+				var live []*MuxConn
+				for _, mc := range list {
+					mc.lk.Lock()
+					idle := len(mc.streams) == 0 && int(now.Sub(mc.idleTime).Seconds()) > sec
+					broken := mc.err != nil
+					mc.lk.Unlock()
+
+					if idle {
+						log.Println("MuxPool.CheckIdleConn close idle connection", sec, mc.cn.Conn.RemoteAddr())
+						mc.fail(errors.New("idle timeout"))
+					} else if !broken {
+						live = append(live, mc)
+					}
+				}
+				p.conns[addr] = live
+			}
+			p.lk.Unlock()
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package syncf
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// answer hello and ack every frame with its stream and seq, except "/slow"
+func serveEcho(t *testing.T, ln net.Listener, remote Hello) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var f Frame
+	var buf []byte
+	for {
+		if buf, err = ReadFrame(conn, &f, buf); err != nil {
+			return
+		}
+		var rsp Frame
+		switch f.Op {
+		case OpHello:
+			rsp = Frame{Op: OpHelloAck, Payload: remote.Encode()}
+		case OpStreamEnd:
+			continue
+		case OpWrite:
+			if f.Path == "/slow" {
+				continue
+			}
+			rsp = Frame{Op: OpResult, Flags: f.Flags & (FlagSeq | FlagStream), Seq: f.Seq, Stream: f.Stream, Pos: f.Pos}
+		default:
+			rsp = Frame{Op: OpResult, Flags: f.Flags & (FlagSeq | FlagStream), Seq: f.Seq, Stream: f.Stream, Pos: f.Pos}
+		}
+		buf, _ := rsp.Encode(nil)
+		if _, err = conn.Write(buf); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestMuxStreams(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	remote := NewHello(1024)
+	remote.MaxStreams = 8
+	remote.StreamWindow = 4
+	go serveEcho(t, ln, remote)
+
+	local := NewHello(1024)
+	local.MaxStreams = 16
+	local.StreamWindow = 2
+	pool := &MuxPool{Pool: &ConnPool{DiaTimout: time.Second, RWTimeout: 5 * time.Second, Hello: &local}}
+
+	var streams []*Stream
+	for i := 0; i < 3; i++ {
+		s, err := pool.OpenStream(ln.Addr().String())
+		if err != nil {
+			t.Fatal("OpenStream failed", err)
+		}
+		if s.Window != 2 {
+			t.Fatal("stream window not negotiated", s.Window)
+		}
+		streams = append(streams, s)
+	}
+	if len(pool.conns[ln.Addr().String()]) != 1 {
+		t.Fatal("streams not on one connection")
+	}
+
+	for i := len(streams) - 1; i >= 0; i-- {
+		f := Frame{Op: OpWrite, Flags: FlagSeq, Seq: uint32(i), Path: "/a", Pos: i}
+		if err = streams[i].Send(&f); err != nil {
+			t.Fatal("Send failed", err)
+		}
+	}
+	for i, s := range streams {
+		rsp, err := s.Recv()
+		if err != nil || rsp.Stream != s.ID || rsp.Pos != i {
+			t.Fatal("Recv failed", err, rsp)
+		}
+		s.Close(false)
+	}
+}
+
+func TestMuxStreamTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	remote := NewHello(1024)
+	remote.MaxStreams = 8
+	remote.StreamWindow = 2
+	go serveEcho(t, ln, remote)
+
+	local := NewHello(1024)
+	pool := &MuxPool{Pool: &ConnPool{DiaTimout: time.Second, RWTimeout: 300 * time.Millisecond, Hello: &local}}
+	slow, err := pool.OpenStream(ln.Addr().String())
+	if err != nil {
+		t.Fatal("OpenStream failed", err)
+	}
+	fast, err := pool.OpenStream(ln.Addr().String())
+	if err != nil {
+		t.Fatal("OpenStream failed", err)
+	}
+
+	if err = slow.Send(&Frame{Op: OpWrite, Path: "/slow"}); err != nil {
+		t.Fatal("Send failed", err)
+	}
+	if _, err = slow.Recv(); err != ErrRecvTimeout {
+		t.Fatal("recv timeout not detected", err)
+	}
+	slow.Close(true)
+
+	// more acks than the recv queue holds are kept, not dropped
+	n := fast.Window + 3
+	for i := 0; i < n; i++ {
+		if err = fast.Send(&Frame{Op: OpWrite, Flags: FlagSeq, Seq: uint32(i), Path: "/a"}); err != nil {
+			t.Fatal("Send on other stream failed", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		rsp, err := fast.Recv()
+		if err != nil || rsp.Seq != uint32(i) {
+			t.Fatal("other stream failed by the timeout", i, err)
+		}
+	}
+	fast.Close(false)
+}
+
+// connections accepted read no faster than the limiter, as a server with rate limit
+type rateListener struct {
+	net.Listener
+	l *RateLimiter
+}
+
+type rateConn struct {
+	net.Conn
+	l *RateLimiter
+}
+
+func (ln rateListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return rateConn{conn, ln.l}, nil
+}
+
+func (c rateConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.l.Wait(n)
+	return n, err
+}
+
+func TestMuxRateLimit(t *testing.T) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nl.Close()
+
+	// 768KB on 4 streams take about 2s at 256KB/s, far longer than RWTimeout
+	const rate, chunk, chunks = 256 * 1024, 16 * 1024, 12
+	remote := NewHello(chunk)
+	remote.MaxStreams = 8
+	remote.StreamWindow = 4
+	remote.RateLimit = rate
+	ln := rateListener{nl, NewRateLimiter(rate, 0)}
+	go serveEcho(t, ln, remote)
+
+	local := NewHello(chunk)
+	pool := &MuxPool{Pool: &ConnPool{DiaTimout: time.Second, RWTimeout: 300 * time.Millisecond, Hello: &local}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		s, err := pool.OpenStream(nl.Addr().String())
+		if err != nil {
+			t.Fatal("OpenStream failed", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close(false)
+			payload := make([]byte, chunk)
+			acked := 0
+			for seq := 0; seq < chunks; seq++ {
+				if err := s.Send(&Frame{Op: OpWrite, Flags: FlagSeq, Seq: uint32(seq), Path: "/a", Payload: payload}); err != nil {
+					t.Error("Send failed", err)
+					return
+				}
+				for seq+1-acked >= s.Window || (seq == chunks-1 && acked < chunks) {
+					if _, err := s.Recv(); err != nil {
+						t.Error("ack of stream", s.ID, "seq", acked, err)
+						return
+					}
+					acked++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,83 @@
+package syncf
+
+import (
+	"sync"
+	"time"
+)
+
+// token bucket of bytes shared by goroutines. tokens are taken before the
+// wait, so a chunk larger than burst waits its whole time and later callers
+// queue behind it. a nil limiter is no limit
+
+type RateLimiter struct {
+	lk     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// nil if rate <= 0, burst defaults to one second of rate
+func NewRateLimiter(rate int, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &RateLimiter{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take n tokens, time to wait before they are available
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// bytes per second, 0 of nil limiter
+func (l *RateLimiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.rate)
+}
+
+// take n tokens without wait, time until they are available. a sender
+// mirroring the limit of its peer knows when the peer has read the bytes
+func (l *RateLimiter) Delay(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	return l.reserve(n)
+}
+
+func (l *RateLimiter) Wait(n int) {
+	WaitRate(n, l)
+}
+
+// wait until n bytes are allowed by all limiters
+func WaitRate(n int, limiters ...*RateLimiter) {
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,46 @@
+package syncf
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var none *RateLimiter
+	if NewRateLimiter(0, 0) != nil {
+		t.Fatal("limiter without rate")
+	}
+	start := time.Now()
+	none.Wait(1 << 30)
+	if time.Since(start) > 10*time.Millisecond {
+		t.Fatal("nil limiter waited")
+	}
+
+	// 10KB burst then 200KB/s, 4 goroutines share it
+	l := NewRateLimiter(200*1024, 10*1024)
+	slow := NewRateLimiter(100*1024, 10*1024)
+	start = time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				l.Wait(1024)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 130*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatal("40KB at 200KB/s took", d)
+	}
+
+	// the slowest of several limits
+	start = time.Now()
+	WaitRate(10*1024, l, slow, nil)
+	WaitRate(10*1024, l, slow, nil)
+	if d := time.Since(start); d < 80*time.Millisecond || d > 400*time.Millisecond {
+		t.Fatal("20KB at 100KB/s took", d)
+	}
+}
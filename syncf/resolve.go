@@ -0,0 +1,167 @@
+package syncf
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// client paths are always taken as relative to a local root. a path is
+// cleaned, ".." and control chars are refused, and the existing part of it is
+// walked so a symlinked dir or file can not lead out of root
+
+const (
+	maxLinkFollow = 40
+)
+
+var (
+	ErrPathInvalid = errors.New("invalid path")
+	ErrPathEscape  = errors.New("path escapes root")
+)
+
+type PathResolver struct {
+	Root string // absolute, symlinks evaluated
+}
+
+func NewPathResolver(root string) (*PathResolver, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &PathResolver{Root: real}, nil
+}
+
+// p as a clean slash path relative to root, "" is root itself
+func CleanPath(p string) (string, error) {
+	if len(p) == 0 {
+		return "", ErrPathInvalid
+	}
+	for _, c := range p {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return "", ErrPathInvalid
+		}
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == ".." {
+			return "", ErrPathInvalid
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+p), "/"), nil
+}
+
+// local name of client path p, confined under root
+func (r *PathResolver) Resolve(p string) (string, error) {
+	rel, err := CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	if _, err = r.walk(r.Root, rel); err != nil {
+		return "", err
+	}
+	return filepath.Join(r.Root, filepath.FromSlash(rel)), nil
+}
+
+// resolver confined to dir p under root, for a client allowed only under p.
+// links on the way to p are followed, they must not lead out of root
+func (r *PathResolver) Sub(p string) (*PathResolver, error) {
+	rel, err := CleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	real, err := r.walk(r.Root, rel)
+	if err != nil {
+		return nil, err
+	}
+	return &PathResolver{Root: real}, nil
+}
+
+// check a link at name, a local name under root, to relative target would
+// not lead out of root through the links already there
+func (r *PathResolver) CheckLink(name string, target string) error {
+	if len(target) == 0 || filepath.IsAbs(target) {
+		return ErrPathInvalid
+	}
+	rel, err := filepath.Rel(r.Root, filepath.Dir(name))
+	if err != nil || !r.inRoot(filepath.Dir(name)) {
+		return ErrPathEscape
+	}
+	dir, err := r.walk(r.Root, filepath.ToSlash(rel))
+	if err != nil {
+		return err
+	}
+	_, err = r.walk(dir, filepath.ToSlash(target))
+	return err
+}
+
+// follow rel from dir cur as the kernel would and return the real path. the
+// part after the first missing name is to be created, ".." is refused there
+func (r *PathResolver) walk(cur string, rel string) (string, error) {
+	names := strings.Split(rel, "/")
+	links := 0
+	missing := false
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+		if len(name) == 0 || name == "." {
+			continue
+		}
+		if name == ".." {
+			if missing {
+				return "", ErrPathEscape
+			}
+			cur = filepath.Dir(cur)
+			if !r.inRoot(cur) {
+				return "", ErrPathEscape
+			}
+			continue
+		}
+
+		next := filepath.Join(cur, name)
+		if missing {
+			cur = next
+			continue
+		}
+		stat, err := os.Lstat(next)
+		if err != nil {
+			missing = true // created under cur, which is in root
+			cur = next
+			continue
+		}
+		if stat.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+
+		links++
+		if links > maxLinkFollow {
+			return "", ErrPathEscape
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			target = filepath.Clean(target)
+			if !r.inRoot(target) {
+				return "", ErrPathEscape
+			}
+			cur = r.Root
+			if target, err = filepath.Rel(r.Root, target); err != nil {
+				return "", ErrPathEscape
+			}
+		}
+		names = append(strings.Split(filepath.ToSlash(target), "/"), names...)
+	}
+	return cur, nil
+}
+
+func (r *PathResolver) inRoot(p string) bool {
+	return p == r.Root || strings.HasPrefix(p, r.Root+string(filepath.Separator)) ||
+		r.Root == string(filepath.Separator)
+}
@@ -0,0 +1,144 @@
+package syncf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathResolver(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root + "/a", outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"a/in":     "..",
+		"a/abs":    root + "/a",
+		"a/out":    "../../outside",
+		"a/absout": outside,
+		"a/dang":   "../../outside/new",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewPathResolver(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path string
+		err  error
+		name string
+	}{
+		{"/a/f.txt", nil, "a/f.txt"},
+		{"a//./b/f.txt", nil, "a/b/f.txt"},
+		{"/", nil, ""},
+		{"/a/in/a/f.txt", nil, "a/in/a/f.txt"},
+		{"/a/abs/f.txt", nil, "a/abs/f.txt"},
+		{"", ErrPathInvalid, ""},
+		{"/a/../../outside/f.txt", ErrPathInvalid, ""},
+		{"/a/f\x00.txt", ErrPathInvalid, ""},
+		{"/a/out/f.txt", ErrPathEscape, ""},
+		{"/a/absout/f.txt", ErrPathEscape, ""},
+		{"/a/dang", ErrPathEscape, ""},
+	} {
+		name, err := r.Resolve(c.path)
+		if err != c.err {
+			t.Fatal("Resolve", c.path, err)
+		}
+		if err == nil && name != filepath.Join(r.Root, c.name) {
+			t.Fatal("Resolve", c.path, name)
+		}
+	}
+}
+
+// links in the dir of a client are confined to it, not only to the root
+func TestPathResolverSub(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"A/p/q", "C"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"A/p/q/B": "../..",
+		"A/p/q/E": "B/..",
+		"L":       "A",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewPathResolver(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := r.Sub("/A")
+	if err != nil || sub.Root != filepath.Join(r.Root, "A") {
+		t.Fatal("Sub failed", err)
+	}
+	if name, err := sub.Resolve("/p/q/B/f.txt"); err != nil || name != filepath.Join(sub.Root, "p/q/B/f.txt") {
+		t.Fatal("Resolve in sub failed", name, err)
+	}
+	if _, err = sub.Resolve("/p/q/E/C/secret"); err != ErrPathEscape {
+		t.Fatal("chained links out of sub not detected", err)
+	}
+	if _, err = r.Resolve("/A/p/q/E/C/secret"); err != nil {
+		t.Fatal("chained links in root refused", err)
+	}
+
+	// dir of a client through a link
+	if sub, err = r.Sub("L"); err != nil || sub.Root != filepath.Join(r.Root, "A") {
+		t.Fatal("Sub through link failed", err)
+	}
+}
+
+// each link of a chain is in the dir when made alone, not through the others
+func TestPathResolverCheckLink(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "A/p/q"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewPathResolver(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := r.Sub("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		target string
+		err    error
+	}{
+		{"p/q/B", "../..", nil},
+		{"p/q/E", "B/..", ErrPathEscape},
+		{"p/q/X", "B/../..", ErrPathEscape},
+		{"p/q/F", "B/p", nil},
+		{"p/q/G", "new/..", ErrPathEscape},
+		{"p/q/H", "../../..", ErrPathEscape},
+		{"p/q/I", "/etc", ErrPathInvalid},
+		{"p/q/B/J", "q", nil}, // made in A through B
+	} {
+		name := filepath.Join(sub.Root, c.name)
+		if err = sub.CheckLink(name, c.target); err != c.err {
+			t.Fatal("CheckLink", c.name, c.target, err)
+		}
+		if err == nil {
+			if err = os.Symlink(c.target, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
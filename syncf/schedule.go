@@ -0,0 +1,196 @@
+package syncf
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// queue of changed files waiting for upload, ordered by rules in turn:
+//
+//	priority  higher Priority of the file first
+//	smallest  smaller file first
+//	largest   larger file first
+//	oldest    file changed earlier first, time of the first change queued
+//	newest    file changed later first
+//
+// a file waiting longer than MaxWait goes before all others, the oldest one
+// first, so a low priority or large file is not starved
+
+const (
+	RulePriority = "priority"
+	RuleSmallest = "smallest"
+	RuleLargest  = "largest"
+	RuleOldest   = "oldest"
+	RuleNewest   = "newest"
+
+	DefaultMaxWait = 300 * time.Second
+)
+
+var (
+	DefaultScheduleRules = []string{RulePriority, RuleSmallest, RuleOldest}
+)
+
+type Scheduler struct {
+	sync.Mutex
+	cond     *sync.Cond
+	rules    []string
+	maxWait  time.Duration
+	priority func(fname string) int   // nil all 0
+	size     func(fname string) int64 // nil all 0
+	items    map[string]*schedItem
+	heap     schedHeap
+	fifo     *list.List // by added, for starved files
+	now      func() time.Time
+}
+
+type schedItem struct {
+	fname    string
+	added    time.Time
+	size     int64
+	priority int
+	index    int // in heap
+	elem     *list.Element
+}
+
+// rules nil for DefaultScheduleRules, maxWait 0 for DefaultMaxWait
+func NewScheduler(rules []string, maxWait time.Duration, priority func(string) int, size func(string) int64) (*Scheduler, error) {
+	if len(rules) == 0 {
+		rules = DefaultScheduleRules
+	}
+	for _, r := range rules {
+		switch r {
+		case RulePriority, RuleSmallest, RuleLargest, RuleOldest, RuleNewest:
+		default:
+			return nil, errors.New("unknown schedule rule " + r)
+		}
+	}
+	if maxWait <= 0 {
+		maxWait = DefaultMaxWait
+	}
+	s := &Scheduler{rules: rules, maxWait: maxWait, priority: priority, size: size,
+		items: make(map[string]*schedItem), fifo: list.New(), now: time.Now}
+	s.heap.s = s
+	s.cond = sync.NewCond(&s.Mutex)
+	return s, nil
+}
+
+// queue fname, a queued file keeps its place in fifo and gets new size
+func (s *Scheduler) AddFile(fname string) {
+	var size int64
+	if s.size != nil {
+		size = s.size(fname)
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if it, ok := s.items[fname]; ok {
+		if it.size != size {
+			it.size = size
+			heap.Fix(&s.heap, it.index)
+		}
+		return
+	}
+	it := &schedItem{fname: fname, added: s.now(), size: size}
+	if s.priority != nil {
+		it.priority = s.priority(fname)
+	}
+	it.elem = s.fifo.PushBack(it)
+	s.items[fname] = it
+	heap.Push(&s.heap, it)
+	s.cond.Signal()
+}
+
+func (s *Scheduler) DelFile(fname string) {
+	s.Lock()
+	defer s.Unlock()
+	if it, ok := s.items[fname]; ok {
+		s.remove(it)
+	}
+}
+
+func (s *Scheduler) remove(it *schedItem) {
+	heap.Remove(&s.heap, it.index)
+	s.fifo.Remove(it.elem)
+	delete(s.items, it.fname)
+}
+
+// wait for a file and remove it from queue
+func (s *Scheduler) Next() string {
+	s.Lock()
+	defer s.Unlock()
+	for len(s.items) == 0 {
+		s.cond.Wait()
+	}
+
+	it := s.fifo.Front().Value.(*schedItem)
+	if s.now().Sub(it.added) < s.maxWait {
+		it = s.heap.items[0]
+	}
+	s.remove(it)
+	return it.fname
+}
+
+func (s *Scheduler) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.items)
+}
+
+func (s *Scheduler) less(a *schedItem, b *schedItem) bool {
+	for _, r := range s.rules {
+		switch r {
+		case RulePriority:
+			if a.priority != b.priority {
+				return a.priority > b.priority
+			}
+		case RuleSmallest:
+			if a.size != b.size {
+				return a.size < b.size
+			}
+		case RuleLargest:
+			if a.size != b.size {
+				return a.size > b.size
+			}
+		case RuleOldest:
+			if !a.added.Equal(b.added) {
+				return a.added.Before(b.added)
+			}
+		case RuleNewest:
+			if !a.added.Equal(b.added) {
+				return a.added.After(b.added)
+			}
+		}
+	}
+	return a.added.Before(b.added)
+}
+
+type schedHeap struct {
+	s     *Scheduler
+	items []*schedItem
+}
+
+func (h *schedHeap) Len() int           { return len(h.items) }
+func (h *schedHeap) Less(i, j int) bool { return h.s.less(h.items[i], h.items[j]) }
+
+func (h *schedHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *schedHeap) Push(x interface{}) {
+	it := x.(*schedItem)
+	it.index = len(h.items)
+	h.items = append(h.items, it)
+}
+
+func (h *schedHeap) Pop() interface{} {
+	n := len(h.items)
+	it := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	return it
+}
@@ -0,0 +1,77 @@
+package syncf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	sizes := map[string]int64{"big.tar": 50 << 30, "a.conf": 100, "b.txt": 4000, "c.txt": 4000, "d.log": 10}
+	prio := map[string]int{"d.log": -1, "urgent.bin": 5}
+	s, err := NewScheduler(nil, time.Minute, func(f string) int { return prio[f] }, func(f string) int64 { return sizes[f] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	for _, f := range []string{"big.tar", "c.txt", "b.txt", "a.conf", "d.log", "urgent.bin"} {
+		now = now.Add(time.Second)
+		s.AddFile(f)
+	}
+	s.AddFile("c.txt") // queued already, keeps its place
+	s.AddFile("gone")
+	s.DelFile("gone")
+
+	for _, want := range []string{"urgent.bin", "a.conf", "c.txt", "b.txt", "big.tar", "d.log"} {
+		if got := s.Next(); got != want {
+			t.Fatal("Next", got, "want", want)
+		}
+	}
+	if s.Len() != 0 {
+		t.Fatal("queue not empty", s.Len())
+	}
+
+	// starved big file goes first, by time queued
+	s.AddFile("big.tar")
+	now = now.Add(30 * time.Second)
+	s.AddFile("a.conf")
+	if got := s.Next(); got != "a.conf" {
+		t.Fatal("Next", got)
+	}
+	s.AddFile("a.conf")
+	now = now.Add(31 * time.Second)
+	if got := s.Next(); got != "big.tar" {
+		t.Fatal("starved file not first", got)
+	}
+
+	if _, err = NewScheduler([]string{"random"}, 0, nil, nil); err == nil {
+		t.Fatal("unknown rule accepted")
+	}
+}
+
+func TestSchedulerRules(t *testing.T) {
+	sizes := map[string]int64{"a": 3, "b": 1, "c": 2}
+	s, _ := NewScheduler([]string{RuleLargest}, 0, nil, func(f string) int64 { return sizes[f] })
+	for _, f := range []string{"b", "a", "c"} {
+		s.AddFile(f)
+	}
+	for _, want := range []string{"a", "c", "b"} {
+		if got := s.Next(); got != want {
+			t.Fatal("Next", got, "want", want)
+		}
+	}
+
+	// Next waits for a file
+	done := make(chan string)
+	go func() { done <- s.Next() }()
+	time.Sleep(10 * time.Millisecond)
+	s.AddFile("b")
+	select {
+	case got := <-done:
+		if got != "b" {
+			t.Fatal("Next", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next not woken")
+	}
+}
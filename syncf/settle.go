@@ -0,0 +1,92 @@
+package syncf
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// files changed by events are held until size and mtime are unchanged for the
+// quiet time, or maxDelay after the first event for files still growing
+
+type Settler struct {
+	sync.Mutex
+	files map[string]*settleFile
+	ready func(fname string)
+	now   func() time.Time
+}
+
+type settleFile struct {
+	quiet    time.Duration
+	maxDelay time.Duration
+	first    time.Time
+	changed  time.Time // last event or size, mtime change
+	size     int64
+	mtime    int64
+}
+
+func NewSettler(ready func(fname string)) *Settler {
+	return &Settler{files: make(map[string]*settleFile), ready: ready, now: time.Now}
+}
+
+// ready at once if quiet <= 0, maxDelay <= 0 is no cap
+func (s *Settler) Add(fname string, quiet time.Duration, maxDelay time.Duration) {
+	if quiet <= 0 {
+		s.ready(fname)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	if f, ok := s.files[fname]; ok {
+		f.changed = now
+		return
+	}
+	f := &settleFile{quiet: quiet, maxDelay: maxDelay, first: now, changed: now, size: -1}
+	f.size, f.mtime = fileSizeTime(fname)
+	s.files[fname] = f
+}
+
+func fileSizeTime(fname string) (int64, int64) {
+	stat, err := os.Lstat(fname)
+	if err != nil {
+		return -1, 0
+	}
+	return stat.Size(), stat.ModTime().UnixNano()
+}
+
+func (s *Settler) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.files)
+}
+
+// files settled or removed are passed to ready
+func (s *Settler) Check() {
+	var settled []string
+	s.Lock()
+	now := s.now()
+	for fname, f := range s.files {
+		size, mtime := fileSizeTime(fname)
+		if size != f.size || mtime != f.mtime {
+			f.size, f.mtime, f.changed = size, mtime, now
+		}
+		if size < 0 || now.Sub(f.changed) >= f.quiet || (f.maxDelay > 0 && now.Sub(f.first) >= f.maxDelay) {
+			settled = append(settled, fname)
+			delete(s.files, fname)
+		}
+	}
+	s.Unlock()
+
+	for _, fname := range settled {
+		s.ready(fname)
+	}
+}
+
+func (s *Settler) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.Check()
+	}
+}
@@ -0,0 +1,69 @@
+package syncf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSettler(t *testing.T) {
+	dir := t.TempDir()
+	growing := filepath.Join(dir, "growing.log")
+	done := filepath.Join(dir, "done.txt")
+	for _, f := range []string{growing, done} {
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ready []string
+	s := NewSettler(func(fname string) { ready = append(ready, fname) })
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	s.Add(filepath.Join(dir, "now"), 0, 0)
+	s.Add(growing, time.Second, 3*time.Second)
+	s.Add(done, time.Second, 3*time.Second)
+	if len(ready) != 1 || s.Len() != 2 {
+		t.Fatal("no quiet time not ready at once", ready, s.Len())
+	}
+
+	// growing.log gets data every 600ms, done.txt settles after 1s
+	for i := 1; i <= 5; i++ {
+		now = now.Add(600 * time.Millisecond)
+		f, err := os.OpenFile(growing, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.WriteString("more")
+		f.Close()
+		s.Check()
+		switch i {
+		case 1:
+			if len(ready) != 1 {
+				t.Fatal("ready before quiet time", ready)
+			}
+		case 2:
+			if len(ready) != 2 || ready[1] != done {
+				t.Fatal("settled file not ready", ready)
+			}
+		case 3, 4:
+			if len(ready) != 2 {
+				t.Fatal("growing file ready before max delay", ready)
+			}
+		case 5:
+			if len(ready) != 3 || ready[2] != growing {
+				t.Fatal("growing file not ready after max delay", ready)
+			}
+		}
+	}
+
+	// removed file is ready on next check
+	s.Add(done, time.Minute, 0)
+	os.Remove(done)
+	s.Check()
+	if len(ready) != 4 || s.Len() != 0 {
+		t.Fatal("removed file not ready", ready)
+	}
+}
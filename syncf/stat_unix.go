@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package syncf
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode of file, 0 if unknown
+func FileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// owner of file, false if unknown
+func FileOwner(fi os.FileInfo) (int, int, bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid), true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package syncf
+
+import (
+	"os"
+)
+
+// inode of file, 0 if unknown
+func FileInode(fi os.FileInfo) uint64 {
+	return 0
+}
+
+// owner of file, false if unknown
+func FileOwner(fi os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
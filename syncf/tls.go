@@ -0,0 +1,86 @@
+package syncf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+)
+
+// tls of the upload channel and the web api, files are pem encoded
+
+var (
+	ErrTLSServerName = errors.New("tls server name not set and addr has no host")
+)
+
+// certPool of the ca file
+func loadCA(ca string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate in " + ca)
+	}
+	return pool, nil
+}
+
+// server with cert and key, client cert signed by ca required if clientAuth
+func ServerTLS(cert string, key string, ca string, clientAuth bool) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}
+	if clientAuth {
+		if len(ca) == 0 {
+			return nil, errors.New("client auth without ca")
+		}
+		if cfg.ClientCAs, err = loadCA(ca); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// server cert verified by ca, system roots if ca empty. cert and key are
+// sent to a server which requires client cert
+func ClientTLS(cert string, key string, ca string, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if len(ca) > 0 {
+		pool, err := loadCA(ca)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if len(cert) > 0 || len(key) > 0 {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+// server name of cfg defaults to the host of addr. addr of unix and pipe is
+// not host:port, the name must be set in cfg
+func clientTLSConn(nc net.Conn, cfg *tls.Config, addr string) (net.Conn, error) {
+	if len(cfg.ServerName) == 0 && !cfg.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || len(host) == 0 {
+			return nil, ErrTLSServerName
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	tc := tls.Client(nc, cfg)
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
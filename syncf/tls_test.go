@@ -0,0 +1,152 @@
+package syncf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write cert and key signed by parent, self signed if parent nil
+func writeCert(t *testing.T, dir string, name string, tmpl *x509.Certificate, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func certTmpl(serial int64, cn string) *x509.Certificate {
+	return &x509.Certificate{SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: cn},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+}
+
+func TestTLSConnPool(t *testing.T) {
+	dir := t.TempDir()
+	caTmpl := certTmpl(1, "test ca")
+	caTmpl.IsCA, caTmpl.BasicConstraintsValid = true, true
+	ca, caKey := writeCert(t, dir, "ca", caTmpl, nil, nil)
+	svrTmpl := certTmpl(2, "server")
+	svrTmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	writeCert(t, dir, "server", svrTmpl, ca, caKey)
+	writeCert(t, dir, "client", certTmpl(3, "client"), ca, caKey)
+	otherTmpl := certTmpl(4, "other ca")
+	otherTmpl.IsCA, otherTmpl.BasicConstraintsValid = true, true
+	writeCert(t, dir, "other", otherTmpl, nil, nil)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	svrCfg, err := ServerTLS(path("server.pem"), path("server.key"), path("ca.pem"), true)
+	if err != nil {
+		t.Fatal("ServerTLS failed", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", svrCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	remote := NewHello(1024)
+	go func() {
+		for i := 0; i < 3; i++ {
+			serveEcho(t, ln, remote)
+		}
+	}()
+
+	dial := func(cert string, key string, ca string) error {
+		cfg, err := ClientTLS(cert, key, ca, "")
+		if err != nil {
+			t.Fatal("ClientTLS failed", err)
+		}
+		local := NewHello(1024)
+		pool := &ConnPool{DiaTimout: time.Second, RWTimeout: 5 * time.Second, Hello: &local, TLS: cfg}
+		cn, err := pool.Get(ln.Addr().String())
+		if err == nil {
+			cn.Conn.Close()
+		}
+		return err
+	}
+
+	if err = dial(path("client.pem"), path("client.key"), path("ca.pem")); err != nil {
+		t.Fatal("mutual tls failed", err)
+	}
+	if err = dial("", "", path("ca.pem")); err == nil {
+		t.Fatal("client without cert accepted")
+	}
+	if err = dial(path("client.pem"), path("client.key"), path("other.pem")); err == nil {
+		t.Fatal("server cert of unknown ca accepted")
+	}
+}
+
+func TestTLSUnixServerName(t *testing.T) {
+	dir := t.TempDir()
+	svrTmpl := certTmpl(1, "server")
+	svrTmpl.IsCA, svrTmpl.BasicConstraintsValid = true, true
+	svrTmpl.DNSNames = []string{"syncf.server"}
+	writeCert(t, dir, "server", svrTmpl, nil, nil)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	svrCfg, err := ServerTLS(path("server.pem"), path("server.key"), "", false)
+	if err != nil {
+		t.Fatal("ServerTLS failed", err)
+	}
+	addr := path("sock")
+	nl, err := UnixTransport{}.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := tls.NewListener(nl, svrCfg)
+	defer ln.Close()
+	remote := NewHello(1024)
+	go func() {
+		for i := 0; i < 2; i++ {
+			serveEcho(t, ln, remote)
+		}
+	}()
+
+	dial := func(name string) error {
+		cfg, err := ClientTLS("", "", path("server.pem"), name)
+		if err != nil {
+			t.Fatal("ClientTLS failed", err)
+		}
+		local := NewHello(1024)
+		pool := &ConnPool{DiaTimout: time.Second, RWTimeout: 5 * time.Second, Hello: &local, TLS: cfg,
+			Transport: UnixTransport{}}
+		cn, err := pool.Get(addr)
+		if err == nil {
+			cn.Conn.Close()
+		}
+		return err
+	}
+
+	if err = dial(""); err != ErrTLSServerName {
+		t.Fatal("unix addr taken as host", err)
+	}
+	if err = dial("syncf.server"); err != nil {
+		t.Fatal("tls over unix failed", err)
+	}
+}
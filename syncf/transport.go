@@ -0,0 +1,157 @@
+package syncf
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// how connections of the upload channel are made. addr is host:port for tcp
+// and kcp, a socket file for unix and any name for pipe
+
+const (
+	TransportTCP  = "tcp"
+	TransportUnix = "unix"
+	TransportKCP  = "kcp"
+)
+
+var (
+	ErrPipeNoListener = errors.New("no pipe listener")
+)
+
+type Transport interface {
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// transport by name in config, kcp is tuned by cfg
+func NewTransport(name string, cfg *KCPConfig) (Transport, error) {
+	switch name {
+	case "", TransportTCP:
+		return TCPTransport{}, nil
+	case TransportUnix:
+		return UnixTransport{}, nil
+	case TransportKCP:
+		return KCPTransport{Config: cfg}, nil
+	}
+	return nil, errors.New("unknown transport " + name)
+}
+
+type TCPTransport struct{}
+
+func (TCPTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+type UnixTransport struct{}
+
+func (UnixTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, timeout)
+}
+
+// socket file left by a stopped server is removed
+func (UnixTransport) Listen(addr string) (net.Listener, error) {
+	if stat, err := os.Lstat(addr); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		if nc, err := net.Dial("unix", addr); err == nil {
+			nc.Close()
+			return nil, errors.New("socket in use " + addr)
+		}
+		_ = os.Remove(addr)
+	}
+	return net.Listen("unix", addr)
+}
+
+type KCPTransport struct {
+	Config *KCPConfig // defaults if nil
+}
+
+// no packet is sent on dial, an unreachable server fails on first read
+func (t KCPTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return DialKCP(addr, t.Config)
+}
+
+func (t KCPTransport) Listen(addr string) (net.Listener, error) {
+	return ListenKCP(addr, t.Config)
+}
+
+// in memory connections by net.Pipe, listen and dial on the same transport
+type PipeTransport struct {
+	lk        sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{listeners: make(map[string]*pipeListener)}
+}
+
+func (t *PipeTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	t.lk.Lock()
+	l, ok := t.listeners[addr]
+	t.lk.Unlock()
+	if !ok {
+		return nil, ErrPipeNoListener
+	}
+
+	local, remote := net.Pipe()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.done:
+		return nil, ErrPipeNoListener
+	case <-timer.C:
+		return nil, &ConnectTimeoutError{addr}
+	}
+}
+
+func (t *PipeTransport) Listen(addr string) (net.Listener, error) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if _, ok := t.listeners[addr]; ok {
+		return nil, errors.New("pipe addr in use " + addr)
+	}
+	l := &pipeListener{t: t, addr: pipeAddr(addr), conns: make(chan net.Conn), done: make(chan struct{})}
+	t.listeners[addr] = l
+	return l, nil
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+type pipeListener struct {
+	t     *PipeTransport
+	addr  pipeAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-l.conns:
+		return nc, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.t.lk.Lock()
+		delete(l.t.listeners, string(l.addr))
+		l.t.lk.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return l.addr }
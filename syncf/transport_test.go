@@ -0,0 +1,96 @@
+package syncf
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hello and one request on each transport through ConnPool
+func TestTransports(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		name string
+		tr   Transport
+		addr string
+	}{
+		{TransportTCP, TCPTransport{}, "127.0.0.1:0"},
+		{TransportUnix, UnixTransport{}, filepath.Join(dir, "sync.sock")},
+		{TransportKCP, KCPTransport{}, "127.0.0.1:0"},
+		{"pipe", NewPipeTransport(), "syncfile"},
+	} {
+		ln, err := c.tr.Listen(c.addr)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		go serveEcho(t, ln, NewHello(1024))
+
+		local := NewHello(1024)
+		pool := &ConnPool{DiaTimout: time.Second, RWTimeout: 5 * time.Second, Hello: &local, Transport: c.tr}
+		cn, err := pool.Get(ln.Addr().String())
+		if err != nil {
+			t.Fatal(c.name, "Get failed", err)
+		}
+		if !cn.Caps.HasFeature(FeatureMux) {
+			t.Fatal(c.name, "hello not negotiated", cn.Caps)
+		}
+		req := Frame{Op: OpWrite, Path: "/a", Pos: 7, Payload: []byte("data")}
+		buf, _ := req.Encode(nil)
+		if _, err = cn.Conn.Write(buf); err != nil {
+			t.Fatal(c.name, err)
+		}
+		var rsp Frame
+		if _, err = ReadFrame(cn.Conn, &rsp, nil); err != nil || rsp.Op != OpResult || rsp.Pos != 7 {
+			t.Fatal(c.name, "bad result", rsp, err)
+		}
+		cn.Conn.Close()
+		ln.Close()
+	}
+}
+
+func TestPipeTransportClosed(t *testing.T) {
+	tr := NewPipeTransport()
+	if _, err := tr.Dial("none", time.Second); err != ErrPipeNoListener {
+		t.Fatal("dial without listener", err)
+	}
+	ln, err := tr.Listen("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tr.Listen("a"); err == nil {
+		t.Fatal("listen twice on same addr")
+	}
+	if _, err = tr.Dial("a", 10*time.Millisecond); err == nil {
+		t.Fatal("dial without accept")
+	}
+	ln.Close()
+	if _, err = ln.Accept(); err != net.ErrClosed {
+		t.Fatal("accept after close", err)
+	}
+	if _, err = tr.Dial("a", time.Second); err != ErrPipeNoListener {
+		t.Fatal("dial after close", err)
+	}
+}
+
+// socket file of a stopped server is reused, one in use is not
+func TestUnixTransportStale(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "sync.sock")
+	ln, err := UnixTransport{}.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = (UnixTransport{}).Listen(addr); err == nil {
+		t.Fatal("listen on socket in use")
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err = os.Lstat(addr); err != nil {
+		t.Fatal("socket file removed", err)
+	}
+	if ln, err = (UnixTransport{}).Listen(addr); err != nil {
+		t.Fatal("listen on stale socket", err)
+	}
+	ln.Close()
+}
@@ -14,6 +14,7 @@ import (
 
 type PathFileReq struct {
 	RPaths []string `json:"rpaths"`
+	Recursive bool `json:"recursive,omitempty"` // files in subdirs too, name is relative path
 }
 
 type PathFileRsq struct {
@@ -29,6 +30,11 @@ type PathFiles struct {
 type FileStat struct {
 	FileName string `json:"filename"`
 	Size int `json:"size"`
+	Ino uint64 `json:"-"` // local only
+	IsDir bool `json:"isdir,omitempty"`
+	Mode uint32 `json:"mode,omitempty"` // os.FileMode
+	ModTime int64 `json:"mtime,omitempty"` // unix nano
+	Link string `json:"link,omitempty"` // target of symlink
 }
 
 var gzipWriterPool = sync.Pool{